@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// The deleteCurrentUserHandler schedules the user's account for deletion. It is only deleted
+// once the grace period has passed, and until then logging in and cancelling the deletion
+// restores it.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	deletionAt := time.Now().Add(app.config.account.deletionGrace)
+
+	err = app.models.Users.ScheduleDeletion(user.ID, deletionAt)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The account is as good as gone, so log it out everywhere and revoke its API keys too
+	err = app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.APIKeys.DeleteAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(user.Email, "account_deletion_scheduled.tmpl", map[string]any{
+			"deletionDate": deletionAt.Format(time.RFC1123),
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{
+		"message":               "your account will be deleted at the end of the grace period",
+		"deletion_scheduled_at": deletionAt,
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) cancelAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Users.CancelDeletion(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your account will no longer be deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The exportCurrentUserHandler returns the user's latest personal data export. If there isn't
+// one yet, a new export is started in the background and the user is emailed once it's ready,
+// so repeating the request just reports on the same export until it's done.
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	export, err := app.models.Exports.GetLatestForUser(user.ID)
+	switch {
+	case err == nil:
+		status := http.StatusAccepted
+		if export.Status == data.ExportComplete {
+			status = http.StatusOK
+		}
+
+		err = app.writeJSON(w, status, envelope{"export": export}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	export, err = app.models.Exports.New(user.ID, app.config.account.exportTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		archive, err := app.buildDataExport(user)
+		if err == nil {
+			err = app.models.Exports.Complete(export.ID, archive)
+		}
+		if err != nil {
+			app.logger.Error(err.Error())
+
+			err = app.models.Exports.Fail(export.ID)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+			return
+		}
+
+		err = app.mailer.Send(user.Email, "data_export_ready.tmpl", map[string]any{
+			"expiry": export.Expiry.Format(time.RFC1123),
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"export": export}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The buildDataExport() method collects everything we store about a user into a JSON archive,
+// including the movies they added. There are no reviews or lists to export.
+func (app *application) buildDataExport(user *data.User) ([]byte, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	identities, err := app.models.Identities.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	movies, err := app.models.Movies.GetAllForCreator(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys, err := app.models.Passkeys.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	totpEnabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := envelope{
+		"exported_at":        time.Now(),
+		"profile":            user,
+		"permissions":        permissions,
+		"sessions":           sessions,
+		"api_keys":           apiKeys,
+		"identities":         identities,
+		"movies":             movies,
+		"passkeys":           passkeys,
+		"two_factor_enabled": totpEnabled,
+	}
+
+	return json.Marshal(archive)
+}
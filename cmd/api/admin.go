@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// The readUserParam() helper looks up the user whose id is in the URL of an admin request. It
+// sends the error response itself, so callers just return when it gives back nil.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) *data.User {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return user
+}
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Search        string
+		Activated     *bool
+		Disabled      *bool
+		CreatedAfter  *time.Time
+		CreatedBefore *time.Time
+		Permission    string
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Search = app.readString(qs, "search", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	input.Disabled = app.readBool(qs, "disabled", v)
+	input.CreatedAfter = app.readTime(qs, "created_after", v)
+	input.CreatedBefore = app.readTime(qs, "created_before", v)
+	input.Permission = app.readString(qs, "permission", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(input.Search, input.Activated, input.Disabled, input.CreatedAfter, input.CreatedBefore, input.Permission, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetNamesForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user, "permissions": permissions, "roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateUserStatusHandler disables or enables a user, and can activate an account on the
+// user's behalf. A disabled user is logged out everywhere and can't log in, use their API keys
+// or activate their account until an admin enables it again.
+func (app *application) updateUserStatusHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		Activated *bool `json:"activated"`
+		Disabled  *bool `json:"disabled"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Activated != nil || input.Disabled != nil, "disabled", "must be provided")
+	v.Check(input.Activated == nil || *input.Activated, "activated", "can only be set to true, disable the account instead")
+	v.Check(input.Disabled == nil || !*input.Disabled || user.ID != app.contextGetUser(r).ID, "disabled", "you can't disable your own account")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if input.Activated != nil {
+		user.Activated = true
+	}
+
+	if input.Disabled != nil {
+		switch {
+		// keep the original time if the account is already disabled
+		case *input.Disabled && user.DisabledAt == nil:
+			now := time.Now()
+			user.DisabledAt = &now
+		case !*input.Disabled:
+			user.DisabledAt = nil
+		}
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.IsDisabled() {
+		err = app.revokeAllSessions(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.invalidateUser(user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The resetUserPasswordHandler forces a user to choose a new password. The current password
+// stops working straight away, the user is logged out everywhere and is sent a password reset
+// token by email.
+func (app *application) resetUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	err := setRandomPassword(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", map[string]any{
+			"passwordResetToken": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{"message": "the user's password was reset and an email was sent with instructions to choose a new one"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	err := app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all of the user's sessions were revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range input.Permissions {
+		v.Check(slices.Contains(known, code), "permissions", "must only contain existing permission codes")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Permissions.AddForUser(user.ID, input.Permissions...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidateUser(user.ID)
+
+	app.writeUserPermissions(w, r, user)
+}
+
+func (app *application) revokeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	code := httprouter.ParamsFromContext(r.Context()).ByName("code")
+
+	// Stop admins from locking themselves (and possibly everyone) out of the admin API
+	if code == "users:admin" && user.ID == app.contextGetUser(r).ID {
+		v := validator.New()
+		v.AddErrors("permission", "you can't revoke your own admin permission")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err := app.models.Permissions.RemoveForUser(user.ID, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidateUser(user.ID)
+
+	app.writeUserPermissions(w, r, user)
+}
+
+// The writeUserPermissions() helper responds with the user's permissions after they changed
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, user *data.User) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
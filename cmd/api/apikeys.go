@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string     `json:"name"`
+		Expiry      *time.Time `json:"expiry"`
+		Permissions []string   `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	key := &data.APIKey{
+		UserID:      user.ID,
+		Name:        input.Name,
+		Expiry:      input.Expiry,
+		Permissions: input.Permissions,
+	}
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// A key can only be given permissions the user has themselves
+	permissions, err := app.userPermissions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, code := range key.Permissions {
+		if !permissions.Include(code) {
+			v.AddErrors("permissions", "must only contain permissions you have: "+code)
+			break
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.APIKeys.New(key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The plaintext key is only ever shown in this response
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, noStore())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Revoke the key, sending a 404 if it doesn't exist or belongs to somebody else
+	err = app.models.APIKeys.DeleteForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "API key successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
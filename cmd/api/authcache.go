@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+)
+
+// authCache saves the database round trips the auth middleware would otherwise make on every
+// request, to look up the user for an authentication token and the user's permissions. Entries
+// are dropped as soon as the tokens are revoked or the permissions change on this instance.
+type authCache struct {
+	tokens      *lruCache[[32]byte, data.User]
+	permissions *lruCache[int64, data.Permissions]
+}
+
+func newAuthCache(ttl time.Duration, size int) authCache {
+	return authCache{
+		tokens:      newLRUCache[[32]byte, data.User](ttl, size),
+		permissions: newLRUCache[int64, data.Permissions](ttl, size),
+	}
+}
+
+// stats() returns the cache metrics, for metricsHandler
+func (c authCache) stats() any {
+	return map[string]any{
+		"tokens":      c.tokens.Stats(),
+		"permissions": c.permissions.Stats(),
+	}
+}
+
+// The metricsHandler serves the auth cache metrics. It doesn't use expvar.Handler(), which
+// would also serve the command line along with any passwords and signing keys passed on it.
+func (app *application) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"auth_cache": app.authCache.stats()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The userForToken() method returns the user an opaque authentication token belongs to. The
+// session's last used time is only recorded when the token isn't cached, so it can lag behind
+// by up to the cache TTL. A token is never cached past its own expiry.
+func (app *application) userForToken(token string) (*data.User, error) {
+	tokenHash := sha256.Sum256([]byte(token))
+
+	if user, found := app.authCache.tokens.Get(tokenHash); found {
+		return &user, nil
+	}
+
+	user, expiry, err := app.models.Users.GetForTokenWithExpiry(data.ScopeAuthentication, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record when the session was last used
+	err = app.models.Tokens.Touch(data.ScopeAuthentication, token)
+	if err != nil {
+		return nil, err
+	}
+
+	app.authCache.tokens.SetWithExpiry(tokenHash, *user, expiry)
+
+	return user, nil
+}
+
+// The userPermissions() method returns the effective permissions of a user
+func (app *application) userPermissions(userID int64) (data.Permissions, error) {
+	if permissions, found := app.authCache.permissions.Get(userID); found {
+		return permissions, nil
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	app.authCache.permissions.Set(userID, permissions)
+
+	return permissions, nil
+}
+
+// The invalidateUser() method drops everything cached for a user. It must be called whenever
+// their tokens are revoked, or their account or permissions change.
+func (app *application) invalidateUser(userID int64) {
+	app.authCache.tokens.DeleteFunc(func(_ [32]byte, user data.User) bool {
+		return user.ID == userID
+	})
+	app.authCache.permissions.Delete(userID)
+}
+
+// The invalidatePermissions() method drops every cached permission set, for changes like
+// editing a role which can affect any number of users.
+func (app *application) invalidatePermissions() {
+	app.authCache.permissions.Clear()
+}
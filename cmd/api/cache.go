@@ -0,0 +1,148 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lruCache is an in-process cache which holds up to size entries for ttl each. When it is full
+// the least recently used entry is evicted. It is safe to use from many goroutines, and counts
+// hits and misses so they can be exported as metrics. A cache with a zero ttl or size stores
+// nothing, which is how caching is turned off.
+type lruCache[K comparable, V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[K]*list.Element
+	order   *list.List
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type lruCacheEntry[K comparable, V any] struct {
+	key    K
+	value  V
+	expiry time.Time
+}
+
+func newLRUCache[K comparable, V any](ttl time.Duration, size int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[K]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get() returns the value for a key, if there is one and it hasn't expired yet.
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+
+	element, found := c.entries[key]
+	if !found {
+		c.misses.Add(1)
+		return zero, false
+	}
+
+	entry := element.Value.(*lruCacheEntry[K, V])
+	if time.Now().After(entry.expiry) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		c.misses.Add(1)
+		return zero, false
+	}
+
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+
+	return entry.value, true
+}
+
+// Set() stores the value for a key, evicting the least recently used entry if the cache is full.
+func (c *lruCache[K, V]) Set(key K, value V) {
+	c.SetWithExpiry(key, value, time.Time{})
+}
+
+// SetWithExpiry() stores the value for a key like Set(), for values which stop being valid at a
+// known time. The entry expires then, or after the cache's ttl if that comes first. A zero
+// expiry means the value has no expiry of its own.
+func (c *lruCache[K, V]) SetWithExpiry(key K, value V, expiry time.Time) {
+	if c.ttl <= 0 || c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if limit := time.Now().Add(c.ttl); expiry.IsZero() || expiry.After(limit) {
+		expiry = limit
+	}
+
+	if element, found := c.entries[key]; found {
+		entry := element.Value.(*lruCacheEntry[K, V])
+		entry.value = value
+		entry.expiry = expiry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruCacheEntry[K, V]{key: key, value: value, expiry: expiry})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruCacheEntry[K, V]).key)
+	}
+}
+
+// Delete() removes a key from the cache.
+func (c *lruCache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.entries[key]; found {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// DeleteFunc() removes every entry for which fn returns true.
+func (c *lruCache[K, V]) DeleteFunc(fn func(key K, value V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.entries {
+		if fn(key, element.Value.(*lruCacheEntry[K, V]).value) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Clear() removes every entry from the cache.
+func (c *lruCache[K, V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[K]*list.Element)
+	c.order.Init()
+}
+
+// Stats() returns the number of hits, misses and entries, for the metrics.
+func (c *lruCache[K, V]) Stats() map[string]int64 {
+	c.mu.Lock()
+	entries := int64(len(c.entries))
+	c.mu.Unlock()
+
+	return map[string]int64{
+		"hits":    c.hits.Load(),
+		"misses":  c.misses.Load(),
+		"entries": entries,
+	}
+}
@@ -10,7 +10,12 @@ import (
 // Custom context key type string
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey   = contextKey("user")
+	tokenContextKey  = contextKey("token")
+	apiKeyContextKey = contextKey("apiKey")
+	cookieContextKey = contextKey("cookieSession")
+)
 
 // This method will return a new copy of the request with the provided User struct added
 // to the context
@@ -29,3 +34,52 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The loadCurrentUser() helper reads the full record of the authenticated user from the
+// database. Use it instead of contextGetUser() when the handler needs more than the user's ID,
+// because with signed tokens the user in the context only has the ID and Activated fields set
+func (app *application) loadCurrentUser(r *http.Request) (*data.User, error) {
+	return app.models.Users.Get(app.contextGetUser(r).ID)
+}
+
+// This will return a new copy of the request with the plaintext authentication token the
+// user was authenticated with added to the context
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// This will return the plaintext authentication token from the request context, or an empty
+// string if the request was not authenticated with one
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// This will return a new copy of the request with the API key the request was authenticated
+// with added to the context
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// This will return the API key from the request context, or nil if the request was not
+// authenticated with one
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// This will return a new copy of the request marked as belonging to a cookie session, either
+// because it was authenticated with the session cookie or refreshed with the refresh cookie
+func (app *application) contextSetCookieSession(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), cookieContextKey, true)
+	return r.WithContext(ctx)
+}
+
+// This will report whether the request belongs to a cookie session rather than using an
+// Authorization header
+func (app *application) contextIsCookieSession(r *http.Request) bool {
+	cookieSession, _ := r.Context().Value(cookieContextKey).(bool)
+	return cookieSession
+}
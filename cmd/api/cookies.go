@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+)
+
+// Browser clients can ask for a cookie session when logging in, by sending this header with the
+// value "cookie". The tokens are then set as HttpOnly cookies instead of being sent in the
+// response body, so scripts on the page can never read them.
+const sessionModeHeader = "X-Session-Mode"
+
+// Names of the cookies used by cookie sessions. The refresh cookie is only sent to the refresh
+// endpoint, and the CSRF cookie is the one cookie scripts can read.
+const (
+	sessionCookieName = "greenlight_session"
+	refreshCookieName = "greenlight_refresh"
+	csrfCookieName    = "greenlight_csrf"
+	csrfHeader        = "X-CSRF-Token"
+	refreshCookiePath = "/v1/tokens/refresh"
+)
+
+// The wantsCookieSession() helper reports whether new session tokens should be sent as cookies
+func (app *application) wantsCookieSession(r *http.Request) bool {
+	return r.Header.Get(sessionModeHeader) == "cookie" || app.contextIsCookieSession(r)
+}
+
+// The csrfTokenFor() function derives the CSRF token of a cookie session from its authentication
+// token. Tying the two together means a CSRF cookie planted by somebody else is useless, and the
+// hash doesn't give away anything about the authentication token itself.
+func csrfTokenFor(token string) string {
+	hash := sha256.Sum256([]byte("csrf:" + token))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// The validCSRFToken() method does the double-submit check for a request authenticated with the
+// session cookie token. State-changing requests must repeat the CSRF cookie in the X-CSRF-Token
+// header, which a page on another site can't do because it can't read our cookies.
+func (app *application) validCSRFToken(r *http.Request, token string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	header := r.Header.Get(csrfHeader)
+
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || header == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(header), []byte(csrfTokenFor(token))) == 1
+}
+
+// The setSessionCookies() method sets the cookies of a cookie session and returns its CSRF token.
+// refreshToken can be nil when only the authentication token has changed.
+func (app *application) setSessionCookies(w http.ResponseWriter, token, refreshToken *data.Token) string {
+	csrfToken := csrfTokenFor(token.Plaintext)
+
+	http.SetCookie(w, app.sessionCookie(sessionCookieName, "/", token.Plaintext, token.Expiry, true))
+	http.SetCookie(w, app.sessionCookie(csrfCookieName, "/", csrfToken, token.Expiry, false))
+
+	if refreshToken != nil {
+		http.SetCookie(w, app.sessionCookie(refreshCookieName, refreshCookiePath, refreshToken.Plaintext, refreshToken.Expiry, true))
+	}
+
+	return csrfToken
+}
+
+// The clearSessionCookies() method tells the browser to delete the cookies of a cookie session
+func (app *application) clearSessionCookies(w http.ResponseWriter) {
+	app.clearAuthenticationCookies(w)
+	app.deleteCookies(w, app.sessionCookie(refreshCookieName, refreshCookiePath, "", time.Time{}, true))
+}
+
+// The clearAuthenticationCookies() method tells the browser to delete the authentication token
+// and CSRF cookies, but not the refresh cookie. It's for when just the authentication token has
+// expired or been revoked, the client can still get a new one with the refresh token.
+func (app *application) clearAuthenticationCookies(w http.ResponseWriter) {
+	app.deleteCookies(w,
+		app.sessionCookie(sessionCookieName, "/", "", time.Time{}, true),
+		app.sessionCookie(csrfCookieName, "/", "", time.Time{}, false),
+	)
+}
+
+func (app *application) deleteCookies(w http.ResponseWriter, cookies ...*http.Cookie) {
+	for _, cookie := range cookies {
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+	}
+}
+
+// The sessionCookie() method returns a cookie with the attributes every session cookie shares
+func (app *application) sessionCookie(name, path, value string, expiry time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   app.config.auth.cookieDomain,
+		Expires:  expiry,
+		HttpOnly: httpOnly,
+		Secure:   app.config.auth.cookieSecure,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
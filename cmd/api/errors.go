@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 )
 
 // the logError() method is a generic helper function for logging any error message
@@ -71,6 +72,13 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter int) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -93,7 +101,42 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) accountDisabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been disabled"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessery permission to access this resources"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) interactiveSessionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an API key, please log in instead"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the Idempotency-Key has already been used with a different request body"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+func (app *application) idempotencyKeyInFlightResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this Idempotency-Key is still being processed, please try again later"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+func (app *application) twoFactorRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "you must enable two-factor authentication to access this resources"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) registrationClosedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "registration of new accounts is closed"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) invalidCSRFTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or missing CSRF token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/mostafejur21/greenlight_go/internal/data"
 	"github.com/mostafejur21/greenlight_go/internal/validator"
 )
 
@@ -59,6 +64,12 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	return nil
 }
 
+// The noStore() helper returns the headers for a response with a credential in it, like a token,
+// an API key or a TOTP secret. Neither caches nor the idempotency() middleware keep a copy of it.
+func noStore() http.Header {
+	return http.Header{"Cache-Control": {"no-store"}}
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
 	// set the max json body size.
 	maxBytes := 1_048_576 // (1MB)
@@ -118,6 +129,16 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	return nil
 }
 
+// The clientIP() helper returns the IP address of the client which made the request, without
+// the port number.
+func (app *application) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
 // The readString() helper method will returns a string value from query string, or the provided
 // default value if no matching key could not found.
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -146,6 +167,40 @@ func (app *application) readCSV(qs url.Values, key string, defaultValue []string
 	return strings.Split(csv, ",")
 }
 
+// The readBool() helper reads an optional boolean value from the query string, or nil if it isn't there.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddErrors(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// The readTime() helper reads an optional RFC 3339 timestamp from the query string, or nil if it isn't there.
+func (app *application) readTime(qs url.Values, key string, v *validator.Validator) *time.Time {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		v.AddErrors(key, "must be an RFC 3339 timestamp")
+		return nil
+	}
+
+	return &t
+}
+
 // The readInt() helper method reads a string value from the query string and converts it to an
 // integer before returning it. if no matching value found, then it will return the default value.
 // if the value could not be convert into an integer, then we record an error message in the provided
@@ -188,3 +243,29 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// The setRandomPassword() function sets a random password on a user which nobody knows, so the
+// only way to log in with a password is to reset it first.
+func setRandomPassword(user *data.User) error {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	return user.Password.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+}
+
+// The validatePasswordPolicy() helper checks a new password for a user against the password
+// policy. It is skipped when the password has already failed data.ValidatePasswordPlainText(),
+// so there is only one error for it and overly long passwords aren't estimated.
+func (app *application) validatePasswordPolicy(v *validator.Validator, password string, user *data.User) {
+	if _, exists := v.Errors["password"]; exists {
+		return
+	}
+
+	if message := app.passwordPolicy.Check(password, user.Name, user.Email); message != "" {
+		v.AddErrors("password", message)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/jwt"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// The introspectTokenHandler lets other services check an authentication token presented to
+// them, in the style of RFC 7662. Callers need the tokens:introspect permission, normally through
+// an API key. Any token which isn't valid for authenticating with right now is reported as
+// inactive, without saying why.
+func (app *application) introspectTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if v.Check(input.TokenPlaintext != "", "token", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// the response describes a credential, so it must never be cached
+	headers := noStore()
+
+	user, issuedAt, expiry, err := app.introspectToken(input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusOK, envelope{"active": false}, headers)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"active":      true,
+		"scope":       data.ScopeAuthentication,
+		"sub":         strconv.FormatInt(user.ID, 10),
+		"user_id":     user.ID,
+		"activated":   user.Activated,
+		"iat":         issuedAt.Unix(),
+		"exp":         expiry.Unix(),
+		"permissions": permissions,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The introspectToken() method returns the user an authentication token belongs to, along with
+// when it was issued and when it expires. It returns ErrRecordNotFound for tokens which aren't
+// valid, just like authenticate() would reject them.
+func (app *application) introspectToken(token string) (*data.User, time.Time, time.Time, error) {
+	if app.signer != nil && jwt.LooksSigned(token) {
+		claims, err := app.signer.Verify(token, time.Now())
+		if err != nil || claims.Scope != data.ScopeAuthentication || app.isDenied(claims) {
+			return nil, time.Time{}, time.Time{}, data.ErrRecordNotFound
+		}
+
+		user := &data.User{ID: claims.Subject, Activated: claims.Activated}
+
+		return user, time.Unix(claims.IssuedAt, 0), time.Unix(claims.ExpiresAt, 0), nil
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return nil, time.Time{}, time.Time{}, data.ErrRecordNotFound
+	}
+
+	record, err := app.models.Tokens.GetForPlaintext(data.ScopeAuthentication, token)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+
+	return user, record.CreatedAt, record.Expiry, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// Define the signup modes, which decide who can create an account
+const (
+	signupOpen            = "open"
+	signupInviteOnly      = "invite-only"
+	signupDomainAllowlist = "domain-allowlist"
+	signupClosed          = "closed"
+)
+
+// The checkSignupConfig() function makes sure the signup mode is known, and that the
+// domain-allowlist mode actually allows some domains
+func checkSignupConfig(cfg config) error {
+	switch cfg.signup.mode {
+	case signupOpen, signupInviteOnly, signupClosed:
+	case signupDomainAllowlist:
+		if len(cfg.signup.allowedDomains) == 0 {
+			return errors.New("domain-allowlist signup mode requires -signup-allowed-domains")
+		}
+	default:
+		return fmt.Errorf("invalid signup mode %q", cfg.signup.mode)
+	}
+
+	if cfg.signup.inviteTTL <= 0 {
+		return errors.New("-signup-invite-ttl must be positive")
+	}
+
+	return nil
+}
+
+// The validateSignup() helper checks that the signup mode lets someone without an invitation
+// create an account for email. The closed mode is handled by the callers, as it isn't something
+// the client can fix.
+func (app *application) validateSignup(v *validator.Validator, email string) {
+	switch app.config.signup.mode {
+	case signupInviteOnly:
+		v.AddErrors("invite_token", "must be provided, registration is by invitation only")
+	case signupDomainAllowlist:
+		domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+		v.Check(slices.Contains(app.config.signup.allowedDomains, domain), "email", "must use an email domain which is allowed to register")
+	}
+}
+
+// The readInvitation() helper looks up the invitation for the token sent with a registration,
+// adding a validation error if there isn't a usable one for email
+func (app *application) readInvitation(v *validator.Validator, tokenPlaintext, email string) (*data.Invitation, error) {
+	if v.Check(len(tokenPlaintext) == 26, "invite_token", "must be 26 bytes long"); !v.Valid() {
+		return nil, nil
+	}
+
+	invitation, err := app.models.Invitations.GetForToken(tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("invite_token", "invalid or expired invitation token")
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	// The invitation proves ownership of one email address only
+	v.Check(strings.EqualFold(invitation.Email, email), "email", "must be the email address the invitation was sent to")
+
+	return invitation, nil
+}
+
+func (app *application) listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	invitations, err := app.models.Invitations.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invitations": invitations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createInvitationHandler invites someone to register, by emailing them an invitation
+// token. The permissions are granted to the account when it's created.
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string     `json:"email"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	invitedBy := app.contextGetUser(r).ID
+
+	invitation := &data.Invitation{
+		Email:       input.Email,
+		Permissions: input.Permissions,
+		InvitedBy:   &invitedBy,
+		Expiry:      time.Now().Add(app.config.signup.inviteTTL),
+	}
+
+	if input.Expiry != nil {
+		invitation.Expiry = *input.Expiry
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateInvitation(v, invitation)
+	for _, code := range invitation.Permissions {
+		v.Check(slices.Contains(known, code), "permissions", "must only contain existing permission codes")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(invitation.Email)
+	switch {
+	case err == nil:
+		v.AddErrors("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Invitations.New(invitation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(invitation.Email, "user_invitation.tmpl", map[string]any{
+			"invitationToken": invitation.Plaintext,
+			"email":           invitation.Email,
+			"expiry":          invitation.Expiry.Format(time.RFC1123),
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Invitations.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "invitation successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// The loginBlockedFor() helper returns how much longer logins for the failure's key must wait.
+// The first few failures are free, after that each failure doubles the wait, and once the
+// lockout threshold is reached the key is locked for the lockout duration. Client IPs are
+// only ever locked out, with a much higher threshold, because many users can share one IP.
+func (app *application) loginBlockedFor(failure *data.LoginFailure) time.Duration {
+	var blocked time.Duration
+
+	switch {
+	case failure.IsIP():
+		if failure.Failures >= app.config.login.ipLockoutAttempts {
+			blocked = app.config.login.lockoutDuration
+		}
+	case failure.Failures >= app.config.login.lockoutAttempts:
+		blocked = app.config.login.lockoutDuration
+	case failure.Failures >= app.config.login.freeAttempts:
+		exponent := float64(failure.Failures - app.config.login.freeAttempts)
+		blocked = time.Duration(math.Pow(2, exponent)) * time.Second
+	}
+
+	return time.Until(failure.LastFailure.Add(blocked))
+}
+
+// The checkLoginThrottle() helper returns how long the client has to wait before it may try to
+// log in to the email address again, or zero if it may try now
+func (app *application) checkLoginThrottle(r *http.Request, email string) (time.Duration, error) {
+	failures, err := app.models.Logins.GetAll(data.LoginFailureEmailKey(email), data.LoginFailureIPKey(app.clientIP(r)))
+	if err != nil {
+		return 0, err
+	}
+
+	var wait time.Duration
+
+	for _, failure := range failures {
+		wait = max(wait, app.loginBlockedFor(failure))
+	}
+
+	return wait, nil
+}
+
+// The recordLoginAttempt() helper counts a login attempt as a failure for the email address and
+// client IP before the password is checked, so concurrent attempts can't all get past the
+// throttle before any of them is counted. It returns the email address's count, and how long
+// the client has to wait if this attempt is over the limit. A successful login takes the
+// attempt back with loginSucceeded().
+func (app *application) recordLoginAttempt(r *http.Request, email string) (*data.LoginFailure, time.Duration, error) {
+	ipFailure, err := app.models.Logins.RecordFailure(data.LoginFailureIPKey(app.clientIP(r)), app.config.login.failureWindow)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	emailFailure, err := app.models.Logins.RecordFailure(data.LoginFailureEmailKey(email), app.config.login.failureWindow)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var wait time.Duration
+
+	// The counts include this attempt, so it is only allowed while they're within the limits
+	if ipFailure.Failures > app.config.login.ipLockoutAttempts || emailFailure.Failures > app.config.login.lockoutAttempts {
+		wait = max(app.loginBlockedFor(ipFailure), app.loginBlockedFor(emailFailure))
+	}
+
+	return emailFailure, wait, nil
+}
+
+// The loginSucceeded() helper clears the failures for the email address, but only takes this
+// attempt back off the count for the client IP, or an attacker could reset the IP's count with
+// an account of their own
+func (app *application) loginSucceeded(r *http.Request, email string) error {
+	err := app.models.Logins.Reset(data.LoginFailureEmailKey(email))
+	if err != nil {
+		return err
+	}
+
+	return app.models.Logins.Forgive(data.LoginFailureIPKey(app.clientIP(r)))
+}
+
+// The loginFailed() helper emails the owner of the account when the failed attempt counted by
+// recordLoginAttempt() is the one which locked it
+func (app *application) loginFailed(user *data.User, failure *data.LoginFailure) {
+	if failure.Failures == app.config.login.lockoutAttempts {
+		app.background(func() {
+			data := map[string]any{
+				"lockoutMinutes": int(app.config.login.lockoutDuration.Minutes()),
+			}
+
+			err := app.mailer.Send(user.Email, "account_locked.tmpl", data)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		})
+	}
+}
+
+// unlockLoginHandler() lets an admin clear the failed login counts for an email address and/or
+// a client IP address, which lifts any lockout straight away
+func (app *application) unlockLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+		IP    string `json:"ip"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Email != "" || input.IP != "", "email", "email or ip must be provided")
+
+	if input.Email != "" {
+		data.ValidateEmail(v, input.Email)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var keys []string
+
+	if input.Email != "" {
+		keys = append(keys, data.LoginFailureEmailKey(input.Email))
+	}
+
+	if input.IP != "" {
+		keys = append(keys, data.LoginFailureIPKey(input.IP))
+	}
+
+	err = app.models.Logins.Reset(keys...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "login lockout successfully cleared"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// ceilSeconds() rounds a duration up to whole seconds, for the Retry-After header
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
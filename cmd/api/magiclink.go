@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// The createMagicLinkTokenHandler emails the user a single-use login token, so they can log in
+// without their password. Like the password reset endpoint it always sends the same response,
+// so it can't be used to find out which email addresses have an account.
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Throttle by the client's IP address and by the email address, so this endpoint can't be
+	// used to flood somebody's inbox
+	if !app.throttles.magicLinkIP.Allow(app.clientIP(r)) || !app.throttles.magicLinkEmail.Allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.Error(err.Error())
+			}
+			return
+		}
+
+		// a disabled account can't log in, so there's no point sending it a link
+		if user.IsDisabled() {
+			return
+		}
+
+		// Only the newest magic link should work
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeMagicLink, user.ID)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 15*time.Minute, data.ScopeMagicLink)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		err = app.mailer.Send(user.Email, "token_magic_link.tmpl", map[string]any{
+			"magicLinkToken": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{"message": "if an account with that email address exists, you will receive an email with a login link"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The exchangeMagicLinkTokenHandler logs the user in with a magic link token. The token was
+// emailed to the user, so it activates their account too, just like an activation token would.
+// Users with two-factor authentication still have to give a TOTP code.
+func (app *application) exchangeMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userId, err := app.models.Tokens.Consume(data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("token", "invalid or expired magic link token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(userId)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the account may have been disabled after the link was sent
+	if user.IsDisabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	if !user.Activated {
+		user.Activated = true
+
+		err = app.models.Users.Update(user)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.editConflictResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.invalidateUser(user.ID)
+
+		// the activation tokens sent earlier aren't needed anymore
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.completeLogin(w, r, user)
+}
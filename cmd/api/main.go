@@ -3,15 +3,26 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/jwt"
 	"github.com/mostafejur21/greenlight_go/internal/mailer"
+	"github.com/mostafejur21/greenlight_go/internal/oidc"
+	"github.com/mostafejur21/greenlight_go/internal/passhash"
+	"github.com/mostafejur21/greenlight_go/internal/passpolicy"
+	"github.com/mostafejur21/greenlight_go/internal/webauthn"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
 )
 
 const version = "1.0.0"
@@ -39,6 +50,81 @@ type config struct {
 		password string
 		sender   string
 	}
+
+	idempotency struct {
+		ttl   time.Duration
+		lease time.Duration
+	}
+
+	auth struct {
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
+		mode            string
+		signingKeys     string
+		signingKeyID    string
+		denylistRefresh time.Duration
+		cacheTTL        time.Duration
+		cacheSize       int
+		cookieDomain    string
+		cookieSecure    bool
+	}
+
+	oidc struct {
+		providers []oidc.Config
+	}
+
+	totp struct {
+		issuer      string
+		requiredFor []string
+	}
+
+	login struct {
+		freeAttempts      int
+		lockoutAttempts   int
+		ipLockoutAttempts int
+		lockoutDuration   time.Duration
+		failureWindow     time.Duration
+	}
+
+	activation struct {
+		emailInterval time.Duration
+		ipInterval    time.Duration
+		ipBurst       int
+	}
+
+	account struct {
+		deletionGrace time.Duration
+		exportTTL     time.Duration
+	}
+
+	password struct {
+		hasher            string
+		bcryptCost        int
+		argon2Memory      uint
+		argon2Iterations  uint
+		argon2Parallelism uint
+		minStrength       int
+		breachedList      string
+	}
+
+	maintenance struct {
+		interval            time.Duration
+		batchSize           int
+		unactivatedReminder time.Duration
+		unactivatedMaxAge   time.Duration
+	}
+
+	signup struct {
+		mode           string
+		allowedDomains []string
+		inviteTTL      time.Duration
+	}
+
+	webauthn struct {
+		rpID    string
+		rpName  string
+		origins string
+	}
 }
 
 type application struct {
@@ -47,6 +133,36 @@ type application struct {
 	models data.Models
 	mailer mailer.Mailer
 	wg     sync.WaitGroup // sync.WaitGroup is for checking the running background goroutine
+
+	// the rules new passwords have to follow
+	passwordPolicy *passpolicy.Policy
+
+	// our side of passkey registrations and logins
+	webauthn webauthn.RelyingParty
+
+	// shutdown is closed when the server starts shutting down, to stop long running goroutines
+	shutdown chan struct{}
+
+	// per-key limiters used by handlers which send emails, so they can't be used to spam inboxes
+	throttles struct {
+		activationEmail *keyedLimiter
+		activationIP    *keyedLimiter
+		totp            *keyedLimiter
+		magicLinkEmail  *keyedLimiter
+		magicLinkIP     *keyedLimiter
+		resetEmail      *keyedLimiter
+		resetIP         *keyedLimiter
+	}
+
+	// signer is only set when signing keys are configured
+	signer   *jwt.Signer
+	denylist denylistCache
+
+	// the OpenID Connect providers users can log in with, by name
+	oidcProviders map[string]*oidc.Provider
+
+	// cached token and permission lookups for the auth middleware
+	authCache authCache
 }
 
 func main() {
@@ -76,10 +192,150 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "f159be0ee454eb", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.alexedwards.net>", "SMTP sender")
 
+	// how long a stored Idempotency-Key response can be replayed
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "Idempotency-Key replay window")
+	// how long an unfinished request holds its key before a retry can take it over, longer than
+	// any request can run
+	flag.DurationVar(&cfg.idempotency.lease, "idempotency-lease", time.Minute, "Idempotency-Key lease for unfinished requests")
+
+	// lifetime of the tokens issued when a user logs in
+	flag.DurationVar(&cfg.auth.accessTokenTTL, "auth-access-token-ttl", 15*time.Minute, "Authentication token lifetime")
+	flag.DurationVar(&cfg.auth.refreshTokenTTL, "auth-refresh-token-ttl", 30*24*time.Hour, "Refresh token lifetime")
+
+	// signed authentication tokens. In signed mode new logins get signed tokens, but opaque tokens
+	// keep working, and signed tokens are accepted in opaque mode as long as the keys are configured
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "opaque", "Authentication token mode (opaque | signed)")
+	flag.StringVar(&cfg.auth.signingKeys, "auth-signing-keys", os.Getenv("GREENLIGHT_AUTH_SIGNING_KEYS"), "Token signing keys (kid:alg:base64,...)")
+	flag.StringVar(&cfg.auth.signingKeyID, "auth-signing-key-id", "", "Id of the key used to sign new tokens")
+	flag.DurationVar(&cfg.auth.denylistRefresh, "auth-denylist-refresh", 30*time.Second, "Revoked signed token list refresh interval")
+
+	// in-process cache of token and permission lookups. Revocations made by other instances of
+	// the API are only seen once the cached entries expire, and a zero TTL disables the cache
+	flag.DurationVar(&cfg.auth.cacheTTL, "auth-cache-ttl", 30*time.Second, "Token and permission cache lifetime (0 disables the cache)")
+	flag.IntVar(&cfg.auth.cacheSize, "auth-cache-size", 10000, "Maximum number of cached tokens and permission sets")
+
+	// cookie sessions for browser clients, which ask for one with the X-Session-Mode: cookie header
+	flag.StringVar(&cfg.auth.cookieDomain, "auth-cookie-domain", "", "Domain of the session cookies (empty for the API host only)")
+	flag.BoolVar(&cfg.auth.cookieSecure, "auth-cookie-secure", true, "Only send session cookies over HTTPS (disable for local development)")
+
+	// OpenID Connect providers, the flag can be repeated for each provider
+	flag.Func("oidc-provider", "OpenID Connect provider (name=...,issuer=...,client-id=...,client-secret=...,redirect-uri=...)", func(val string) error {
+		provider, err := oidc.ParseConfig(val)
+		if err != nil {
+			return err
+		}
+		cfg.oidc.providers = append(cfg.oidc.providers, provider)
+		return nil
+	})
+
+	// two-factor authentication. Users need 2FA enabled to use any of the -totp-required-for
+	// permissions, e.g. -totp-required-for="movies:write"
+	flag.StringVar(&cfg.totp.issuer, "totp-issuer", "Greenlight", "Issuer name shown in authenticator apps")
+	flag.Func("totp-required-for", "Comma separated permission codes which require 2FA", func(val string) error {
+		cfg.totp.requiredFor = strings.FieldsFunc(val, func(c rune) bool { return c == ',' || c == ' ' })
+		return nil
+	})
+
+	// brute-force protection for logins
+	flag.IntVar(&cfg.login.freeAttempts, "login-free-attempts", 5, "Failed logins per account before backoff starts")
+	flag.IntVar(&cfg.login.lockoutAttempts, "login-lockout-attempts", 10, "Failed logins per account before it is locked")
+	flag.IntVar(&cfg.login.ipLockoutAttempts, "login-ip-lockout-attempts", 100, "Failed logins per client IP before it is locked")
+	flag.DurationVar(&cfg.login.lockoutDuration, "login-lockout-duration", 15*time.Minute, "How long a locked account or IP stays locked")
+	flag.DurationVar(&cfg.login.failureWindow, "login-failure-window", 24*time.Hour, "Failed logins older than this are forgotten")
+
+	// throttling for resending activation emails
+	flag.DurationVar(&cfg.activation.emailInterval, "activation-email-interval", 5*time.Minute, "Minimum interval between activation emails to the same address")
+	flag.DurationVar(&cfg.activation.ipInterval, "activation-ip-interval", time.Minute, "Activation email refill interval per client IP")
+	flag.IntVar(&cfg.activation.ipBurst, "activation-ip-burst", 5, "Activation email maximum burst per client IP")
+
+	// account deletion and personal data exports
+	flag.DurationVar(&cfg.account.deletionGrace, "account-deletion-grace", 30*24*time.Hour, "How long a deleted account can still be restored")
+	flag.DurationVar(&cfg.account.exportTTL, "account-export-ttl", 7*24*time.Hour, "How long a personal data export is kept")
+
+	// password hashing. Existing hashes keep working after a change, and are replaced on the
+	// next successful login
+	flag.StringVar(&cfg.password.hasher, "password-hasher", "argon2id", "Password hashing algorithm (argon2id | bcrypt)")
+	flag.IntVar(&cfg.password.bcryptCost, "password-bcrypt-cost", 12, "bcrypt cost")
+	flag.UintVar(&cfg.password.argon2Memory, "password-argon2-memory", uint(passhash.DefaultArgon2id.Memory), "argon2id memory in KiB")
+	flag.UintVar(&cfg.password.argon2Iterations, "password-argon2-iterations", uint(passhash.DefaultArgon2id.Iterations), "argon2id iterations")
+	flag.UintVar(&cfg.password.argon2Parallelism, "password-argon2-parallelism", uint(passhash.DefaultArgon2id.Parallelism), "argon2id parallelism")
+
+	// password policy for new passwords
+	flag.IntVar(&cfg.password.minStrength, "password-min-strength", 3, "Minimum password strength score (0-4)")
+	flag.StringVar(&cfg.password.breachedList, "password-breached-list", "", "File of breached password SHA-1 hashes (empty disables the check)")
+
+	// background database cleanup
+	flag.DurationVar(&cfg.maintenance.interval, "maintenance-interval", time.Hour, "Interval between database cleanup runs")
+	flag.IntVar(&cfg.maintenance.batchSize, "maintenance-batch-size", 1000, "Maximum number of rows deleted or emails sent per batch")
+	flag.DurationVar(&cfg.maintenance.unactivatedReminder, "maintenance-unactivated-reminder", 7*24*time.Hour, "Age at which unactivated accounts are reminded to activate")
+	flag.DurationVar(&cfg.maintenance.unactivatedMaxAge, "maintenance-unactivated-max-age", 30*24*time.Hour, "Age at which reminded unactivated accounts are deleted")
+
+	// who can create an account. Invited users can register in every mode except closed
+	flag.StringVar(&cfg.signup.mode, "signup-mode", signupOpen, "Who can register (open | invite-only | domain-allowlist | closed)")
+	flag.Func("signup-allowed-domains", "Comma separated email domains which can register in domain-allowlist mode", func(val string) error {
+		cfg.signup.allowedDomains = strings.FieldsFunc(strings.ToLower(val), func(c rune) bool { return c == ',' || c == ' ' })
+		return nil
+	})
+	flag.DurationVar(&cfg.signup.inviteTTL, "signup-invite-ttl", 7*24*time.Hour, "Default invitation lifetime")
+
+	// passkeys. The relying party id is the domain passkeys are bound to, and every origin the
+	// frontend is served from has to be on it
+	flag.StringVar(&cfg.webauthn.rpID, "webauthn-rp-id", "localhost", "WebAuthn relying party id (the domain passkeys are bound to)")
+	flag.StringVar(&cfg.webauthn.rpName, "webauthn-rp-name", "Greenlight", "WebAuthn relying party name shown by authenticators")
+	flag.StringVar(&cfg.webauthn.origins, "webauthn-origins", "http://localhost:8080", "Comma separated web origins allowed to use passkeys")
+
 	flag.Parse()
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
+	signer, err := openSigner(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	data.PasswordHasher, err = openPasswordHasher(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	passwordPolicy := &passpolicy.Policy{MinScore: cfg.password.minStrength}
+
+	if cfg.password.breachedList != "" {
+		passwordPolicy.Breached, err = passpolicy.LoadBreachedList(cfg.password.breachedList)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+
+		logger.Info("breached password list loaded", "hashes", passwordPolicy.Breached.Len())
+	}
+
+	// unactivated users are deleted some time after they have been reminded, never before
+	if cfg.maintenance.unactivatedMaxAge <= cfg.maintenance.unactivatedReminder {
+		logger.Error("-maintenance-unactivated-max-age must be longer than -maintenance-unactivated-reminder")
+		os.Exit(1)
+	}
+
+	err = checkSignupConfig(cfg)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	relyingParty := webauthn.RelyingParty{
+		ID:      cfg.webauthn.rpID,
+		Name:    cfg.webauthn.rpName,
+		Origins: strings.FieldsFunc(cfg.webauthn.origins, func(c rune) bool { return c == ',' || c == ' ' }),
+	}
+
+	err = relyingParty.Validate()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.Error(err.Error())
@@ -94,8 +350,46 @@ func main() {
 		logger: logger,
 		models: data.NewModels(db),
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		signer: signer,
+
+		passwordPolicy: passwordPolicy,
+		webauthn:       relyingParty,
+
+		shutdown: make(chan struct{}),
+
+		oidcProviders: make(map[string]*oidc.Provider),
+	}
+
+	oidcClient := &http.Client{Timeout: 10 * time.Second}
+	for _, provider := range cfg.oidc.providers {
+		app.oidcProviders[provider.Name] = oidc.NewProvider(provider, oidcClient)
 	}
 
+	app.throttles.activationEmail = newKeyedLimiter(rate.Every(cfg.activation.emailInterval), 1)
+	app.throttles.activationIP = newKeyedLimiter(rate.Every(cfg.activation.ipInterval), cfg.activation.ipBurst)
+	app.throttles.totp = newKeyedLimiter(rate.Every(time.Minute), 5)
+
+	// magic link emails are throttled just like activation emails
+	app.throttles.magicLinkEmail = newKeyedLimiter(rate.Every(cfg.activation.emailInterval), 1)
+	app.throttles.magicLinkIP = newKeyedLimiter(rate.Every(cfg.activation.ipInterval), cfg.activation.ipBurst)
+
+	// and so are password reset emails
+	app.throttles.resetEmail = newKeyedLimiter(rate.Every(cfg.activation.emailInterval), 1)
+	app.throttles.resetIP = newKeyedLimiter(rate.Every(cfg.activation.ipInterval), cfg.activation.ipBurst)
+
+	app.authCache = newAuthCache(cfg.auth.cacheTTL, cfg.auth.cacheSize)
+
+	if app.signer != nil {
+		err = app.loadDenylist()
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		app.refreshDenylist()
+	}
+
+	app.startMaintenance()
+
 	err = app.serve()
 	if err != nil {
 		logger.Error(err.Error())
@@ -103,6 +397,53 @@ func main() {
 	}
 }
 
+// The openSigner() function returns the signer for signed authentication tokens, or nil if no
+// signing keys are configured
+func openSigner(cfg config) (*jwt.Signer, error) {
+	if cfg.auth.mode != "opaque" && cfg.auth.mode != "signed" {
+		return nil, fmt.Errorf("invalid auth mode %q", cfg.auth.mode)
+	}
+
+	if cfg.auth.signingKeys == "" {
+		if cfg.auth.mode == "signed" {
+			return nil, errors.New("signed auth mode requires -auth-signing-keys")
+		}
+		return nil, nil
+	}
+
+	keys, err := jwt.ParseKeys(cfg.auth.signingKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.New(keys, cfg.auth.signingKeyID)
+}
+
+// The openPasswordHasher() function returns the hasher for new password hashes
+func openPasswordHasher(cfg config) (passhash.Hasher, error) {
+	switch cfg.password.hasher {
+	case "bcrypt":
+		if cfg.password.bcryptCost < bcrypt.MinCost || cfg.password.bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("invalid bcrypt cost %d", cfg.password.bcryptCost)
+		}
+		return passhash.Bcrypt{Cost: cfg.password.bcryptCost}, nil
+	case "argon2id":
+		if cfg.password.argon2Memory == 0 || cfg.password.argon2Iterations == 0 ||
+			cfg.password.argon2Parallelism == 0 || cfg.password.argon2Parallelism > 255 {
+			return nil, errors.New("invalid argon2id parameters")
+		}
+
+		hasher := passhash.DefaultArgon2id
+		hasher.Memory = uint32(cfg.password.argon2Memory)
+		hasher.Iterations = uint32(cfg.password.argon2Iterations)
+		hasher.Parallelism = uint8(cfg.password.argon2Parallelism)
+
+		return hasher, nil
+	default:
+		return nil, fmt.Errorf("invalid password hasher %q", cfg.password.hasher)
+	}
+}
+
 // The OpenDB() function returns as a sql.DB connection pool
 func openDB(cfg config) (*sql.DB, error) {
 	// Use sql.Open() to create an empty connection pool, using the DSN from the config struct
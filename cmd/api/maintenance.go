@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+)
+
+// The startMaintenance() method launches the background scheduler which cleans up the database
+// once every interval. It runs under app.wg and stops when the server shuts down, so serve()
+// waits for a run in progress to finish.
+func (app *application) startMaintenance() {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		ticker := time.NewTicker(app.config.maintenance.interval)
+		defer ticker.Stop()
+
+		for {
+			app.runMaintenance()
+
+			select {
+			case <-ticker.C:
+			case <-app.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// The runMaintenance() method runs every maintenance job once. A job which fails is logged and
+// doesn't stop the others.
+func (app *application) runMaintenance() {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.Error(fmt.Sprintf("%v", err))
+		}
+	}()
+
+	jobs := []struct {
+		name string
+		fn   func() (int64, error)
+	}{
+		{"expired tokens", app.purgeExpiredTokens},
+		{"expired data exports", app.models.Exports.DeleteExpired},
+		{"expired idempotency keys", app.models.Idempotency.DeleteExpired},
+		{"expired invitations", app.models.Invitations.DeleteExpired},
+		{"expired passkey challenges", app.models.Passkeys.DeleteExpiredChallenges},
+		{"expired denylist entries", app.models.Denylist.DeleteExpired},
+		{"expired oidc login states", app.models.Identities.DeleteExpiredStates},
+		{"old login failures", app.purgeLoginFailures},
+		{"deleted accounts", app.models.Users.PurgeDeleted},
+		{"activation reminders", app.sendActivationReminders},
+		{"unactivated accounts", app.purgeUnactivatedAccounts},
+	}
+
+	for _, job := range jobs {
+		count, err := job.fn()
+		if err != nil {
+			app.logger.Error(err.Error(), "job", job.name)
+			continue
+		}
+
+		if count > 0 {
+			app.logger.Info("maintenance job completed", "job", job.name, "count", count)
+		}
+	}
+}
+
+// stopping() reports whether the server is shutting down, so long running jobs can stop early
+func (app *application) stopping() bool {
+	select {
+	case <-app.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// The purgeExpiredTokens() method deletes expired tokens in batches until there are none left
+func (app *application) purgeExpiredTokens() (int64, error) {
+	var total int64
+
+	for !app.stopping() {
+		deleted, err := app.models.Tokens.DeleteExpired(app.config.maintenance.batchSize)
+		if err != nil {
+			return total, err
+		}
+
+		total += deleted
+
+		if deleted < int64(app.config.maintenance.batchSize) {
+			break
+		}
+	}
+
+	return total, nil
+}
+
+// The purgeLoginFailures() method deletes the failure counts which no longer matter, once they
+// are past the failure window and any lockout they caused is over
+func (app *application) purgeLoginFailures() (int64, error) {
+	return app.models.Logins.DeleteOlderThan(app.config.login.failureWindow + app.config.login.lockoutDuration)
+}
+
+// The sendActivationReminders() method emails a fresh activation token to users who haven't
+// activated their account after unactivatedReminder, warning them it will be deleted once it is
+// unactivatedMaxAge old.
+func (app *application) sendActivationReminders() (int64, error) {
+	// how long the user has between the reminder and the deletion
+	notice := app.config.maintenance.unactivatedMaxAge - app.config.maintenance.unactivatedReminder
+
+	users, err := app.models.Users.GetUnactivatedForReminder(time.Now().Add(-app.config.maintenance.unactivatedReminder), app.config.maintenance.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var sent int64
+
+	for _, user := range users {
+		if app.stopping() {
+			break
+		}
+
+		token, err := app.models.Tokens.New(user.ID, notice, data.ScopeActivation)
+		if err != nil {
+			return sent, err
+		}
+
+		err = app.mailer.Send(user.Email, "activation_reminder.tmpl", map[string]any{
+			"activationToken": token.Plaintext,
+			"deletionDate":    time.Now().Add(notice).Format(time.RFC1123),
+		})
+		// leave the user to be reminded on the next run
+		if err != nil {
+			app.logger.Error(err.Error(), "user_id", user.ID)
+			continue
+		}
+
+		err = app.models.Users.MarkActivationReminderSent(user.ID)
+		if err != nil {
+			return sent, err
+		}
+
+		sent++
+	}
+
+	return sent, nil
+}
+
+// The purgeUnactivatedAccounts() method deletes the accounts which were never activated, once
+// they are unactivatedMaxAge old and the user has had the full notice period since the reminder
+func (app *application) purgeUnactivatedAccounts() (int64, error) {
+	notice := app.config.maintenance.unactivatedMaxAge - app.config.maintenance.unactivatedReminder
+	now := time.Now()
+
+	return app.models.Users.DeleteUnactivated(now.Add(-app.config.maintenance.unactivatedMaxAge), now.Add(-notice))
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/jwt"
 	"github.com/mostafejur21/greenlight_go/internal/validator"
 	"golang.org/x/time/rate"
 )
@@ -26,14 +31,25 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		// If no authorizationHeader found, then use contextSetUser() helper
 		if authorizationHeader == "" {
+			// Browser clients using a cookie session send their token in a cookie instead
+			if cookie, err := r.Cookie(sessionCookieName); err == nil {
+				app.authenticateCookie(w, r, next, cookie.Value)
+				return
+			}
+
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		// Otherwise, we except the value of the Authorization header to be in the format
-		// "Bearer <token>", we try to split into its constituent part
+		// "Bearer <token>" or "ApiKey <key>", we try to split into its constituent part
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		}
+
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
@@ -42,16 +58,8 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Extract the actual authenticate token from the parts
 		token := headerParts[1]
 
-		// Validate
-		v := validator.New()
-
-		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
-			return
-		}
-
 		// Retrieve the details for the user associated with the token
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		user, err := app.userForAuthenticationToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -64,12 +72,99 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		// Call the contextSetUser() helper to add the user information request context
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 
 		//call the next handler in the chain
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The userForAuthenticationToken() method returns the user an authentication token belongs to,
+// or ErrRecordNotFound if the token isn't valid. Signed tokens are verified locally, without
+// touching the database, so the user then only has the ID and Activated fields set.
+func (app *application) userForAuthenticationToken(token string) (*data.User, error) {
+	if app.signer != nil && jwt.LooksSigned(token) {
+		claims, err := app.signer.Verify(token, time.Now())
+		if err != nil || claims.Scope != data.ScopeAuthentication || app.isDenied(claims) {
+			return nil, data.ErrRecordNotFound
+		}
+
+		return &data.User{ID: claims.Subject, Activated: claims.Activated}, nil
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+		return nil, data.ErrRecordNotFound
+	}
+
+	return app.userForToken(token)
+}
+
+// The authenticateCookie() method authenticates a request made with a session cookie. A cookie
+// with a token which is no longer valid is cleared and the request carries on anonymously, so a
+// stale cookie can't get in the way of logging in again. The refresh cookie is kept, so the
+// client can still refresh its session. State-changing requests also have to
+// pass the CSRF check, since the browser sends the cookie whichever site made the request.
+func (app *application) authenticateCookie(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	user, err := app.userForAuthenticationToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.clearAuthenticationCookies(w)
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !app.validCSRFToken(r, token) {
+		app.invalidCSRFTokenResponse(w, r)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetToken(r, token)
+	r = app.contextSetCookieSession(r)
+
+	next.ServeHTTP(w, r)
+}
+
+// authenticateAPIKey() authenticates a request made with an "ApiKey <key>" Authorization header
+// as the user who owns the key
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	key, user, err := app.models.APIKeys.GetForPlaintext(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.APIKeys.Touch(key.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r = app.contextSetUser(r, user)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Create a deferred function (which will always be run in the event of a panic
@@ -198,6 +293,22 @@ func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.Han
 	})
 }
 
+// Check that a user is authenticated with a session rather than an API key. API keys are
+// limited to the permissions they were given, so they mustn't be able to manage the account,
+// its sessions or its credentials, whatever their permissions are.
+func (app *application) requireInteractiveSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.interactiveSessionRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireAuthenticatedUser(fn)
+}
+
 // New middleware for checking the permission for a user
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
@@ -205,7 +316,7 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 		user := app.contextGetUser(r)
 
 		// Get the slice of permission for the user
-		permission, err := app.models.Permissions.GetAllForUser(user.ID)
+		permission, err := app.userPermissions(user.ID)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -217,8 +328,189 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			return
 		}
 
+		// An API key can only use the permissions it was given, and only as long as its owner
+		// still has them
+		if key := app.contextGetAPIKey(r); key != nil && !key.Permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		// Some permissions can only be used once two-factor authentication is enabled
+		if slices.Contains(app.config.totp.requiredFor, code) {
+			enabled, err := app.models.TOTP.IsEnabled(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if !enabled {
+				app.twoFactorRequiredResponse(w, r)
+				return
+			}
+		}
+
 		next.ServeHTTP(w, r)
 	}
 
 	return app.requireActivatedUser(fn)
 }
+
+// idempotencyRecorder wraps the http.ResponseWriter and keeps a copy of the status code and
+// body written by the handler, so the response can be stored for an Idempotency-Key.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// The idempotency() middleware honors the Idempotency-Key header on POST requests. The first
+// request with a key is processed normally and its response is stored, any retry with the
+// same key (for the same user) gets the stored response replayed instead of running the
+// handler again. Responses which carry credentials are never stored, see storableResponse().
+func (app *application) idempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := validator.New()
+		if data.ValidateIdempotencyKey(v, key); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		// Read the body so we can hash it, then put it back for the handler to decode
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+		if err != nil {
+			app.badRequestRespons(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// The hash covers the method and path too, so a key can't be replayed against a
+		// different endpoint
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+
+		user := app.contextGetUser(r)
+
+		record := &data.IdempotencyKey{
+			Key:         key,
+			UserID:      user.ID,
+			RequestHash: hash[:],
+			LockedUntil: time.Now().Add(app.config.idempotency.lease),
+			Expiry:      time.Now().Add(app.config.idempotency.ttl),
+		}
+
+		// Anonymous clients all share the same user id, so tell them apart by IP address
+		if user.IsAnonymous() {
+			record.Client = app.clientIP(r)
+		}
+
+		reserved, err := app.models.Idempotency.Reserve(record)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Someone already holds this key, either replay their response or tell the
+		// client to back off
+		if !reserved {
+			existing, err := app.models.Idempotency.Get(key, user.ID, record.Client)
+			if err != nil {
+				switch {
+				// the record expired between Reserve() and Get()
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.idempotencyKeyInFlightResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			if !bytes.Equal(existing.RequestHash, record.RequestHash) {
+				app.idempotencyKeyMismatchResponse(w, r)
+				return
+			}
+
+			if existing.ResponseStatus == nil {
+				app.idempotencyKeyInFlightResponse(w, r)
+				return
+			}
+
+			for key, value := range existing.ResponseHeaders {
+				w.Header()[key] = value
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(*existing.ResponseStatus)
+			w.Write(existing.ResponseBody)
+			return
+		}
+
+		// If the handler panics, release the key before recoverPanic() takes over, so the
+		// client can retry
+		defer func() {
+			if err := recover(); err != nil {
+				app.releaseIdempotencyKey(r, record)
+				panic(err)
+			}
+		}()
+
+		rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Server errors are not stored, the request may well succeed on a retry. Neither are
+		// responses with credentials in them, the client has to make a new request instead.
+		if rec.status >= http.StatusInternalServerError || !storableResponse(rec.Header()) {
+			app.releaseIdempotencyKey(r, record)
+			return
+		}
+
+		record.ResponseStatus = &rec.status
+		record.ResponseHeaders = rec.Header().Clone()
+		record.ResponseBody = rec.body.Bytes()
+
+		err = app.models.Idempotency.Complete(record)
+		if err != nil {
+			// the response has already been sent, so all we can do is log it
+			app.logError(r, err)
+		}
+	})
+}
+
+// releaseIdempotencyKey() deletes a reserved key, logging rather than returning any error
+// because the response to the client has usually been written already.
+func (app *application) releaseIdempotencyKey(r *http.Request, record *data.IdempotencyKey) {
+	err := app.models.Idempotency.Delete(record)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// storableResponse() reports whether a response can be kept for replaying. Tokens, API keys and
+// other secrets are only ever stored as hashes, so responses marked "Cache-Control: no-store" and
+// responses setting cookies mustn't end up in the idempotency_keys table in plaintext.
+func storableResponse(header http.Header) bool {
+	if len(header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+
+	for _, value := range header.Values("Cache-Control") {
+		if strings.Contains(value, "no-store") {
+			return false
+		}
+	}
+
+	return true
+}
@@ -24,12 +24,15 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Copy the values from the input to our own Movies struct.
+	user := app.contextGetUser(r)
+
+	// Copy the values from the input to our own Movies struct, recording who added it.
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		RunTime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		RunTime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: &user.ID,
 	}
 	// initialize a new Validator instance
 	v := validator.New()
@@ -114,6 +117,18 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Check that the user may edit this particular movie
+	allowed, err := app.authorizeMovie(r, movie, canEditMovie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
 	// Declare an input struct to hold the expected data from the client,
 	var input struct {
 		Title   *string       `json:"title"`
@@ -173,6 +188,28 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrInvalidRunTimeFormat):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	allowed, err := app.authorizeMovie(r, movie, canDeleteMovie)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !allowed {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
 	// Delete the movies from the DB, sending a 404 not found response to the client if there is no matching
 	err = app.models.Movies.Delete(id)
 	if err != nil {
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/oidc"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// The readOIDCProvider() helper returns the configured provider named in the URL, or nil
+func (app *application) readOIDCProvider(r *http.Request) *oidc.Provider {
+	params := httprouter.ParamsFromContext(r.Context())
+	return app.oidcProviders[params.ByName("provider")]
+}
+
+// startOIDCLoginHandler() starts an authorization code flow with PKCE. It remembers the state,
+// nonce and code verifier, and returns the URL the client should send the user to.
+func (app *application) startOIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	provider := app.readOIDCProvider(r)
+	if provider == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	state := &data.LoginState{
+		Provider: provider.Name,
+		Expiry:   time.Now().Add(10 * time.Minute),
+	}
+
+	for _, dst := range []*string{&state.State, &state.Nonce, &state.Verifier} {
+		value, err := oidc.GenerateVerifier()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		*dst = value
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state.State, state.Nonce, state.Verifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Identities.InsertState(state)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authorization_url": authURL}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oidcCallbackHandler() finishes the flow. It exchanges the authorization code for an ID token,
+// finds (or links, or creates) the user for it and logs them in.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider := app.readOIDCProvider(r)
+	if provider == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	state, err := app.models.Identities.ConsumeState(provider.Name, input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("state", "invalid or expired login state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), input.Code, state.Verifier, state.Nonce)
+	if err != nil {
+		// the provider's reason is useful to us, but not to the client
+		app.logError(r, err)
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Identities.GetUser(claims.Issuer, claims.Subject)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// First login with this identity
+		user, err = app.linkOIDCIdentity(claims, v)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// The linkOIDCIdentity() helper links a new identity to the user with the same (verified) email
+// address, or creates an activated user for it if there isn't one. Activating only ever means the
+// email address is verified, it can't undo an admin disabling the account. Problems the client can fix
+// are added to the validator.
+func (app *application) linkOIDCIdentity(claims *oidc.Claims, v *validator.Validator) (*data.User, error) {
+	// We only trust the provider with an email address it has verified itself
+	if claims.Email == "" || !claims.EmailVerified {
+		v.AddErrors("email", "the identity provider did not supply a verified email address")
+		return nil, nil
+	}
+
+	user, err := app.models.Users.GetByEmail(claims.Email)
+	switch {
+	case err == nil:
+		// A disabled account is neither linked nor activated, completeLogin() turns it away
+		if user.IsDisabled() {
+			return user, nil
+		}
+
+		// The provider has verified the email address, so it can activate the account too
+		if !user.Activated {
+			user.Activated = true
+
+			err = app.models.Users.Update(user)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.provisionOIDCUser(claims, v)
+		if err != nil || !v.Valid() {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	identity := &data.Identity{
+		Issuer:  claims.Issuer,
+		Subject: claims.Subject,
+		UserID:  user.ID,
+		Email:   claims.Email,
+	}
+
+	err = app.models.Identities.Insert(identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// The provisionOIDCUser() helper creates an activated account for a first time OIDC login,
+// with the same default permission as registerUserHandler() gives, if the signup mode allows it
+func (app *application) provisionOIDCUser(claims *oidc.Claims, v *validator.Validator) (*data.User, error) {
+	// The provider verified the email address, but the signup mode still decides whether an
+	// account can be created for it. There is no way to present an invitation here.
+	switch app.config.signup.mode {
+	case signupClosed, signupInviteOnly:
+		v.AddErrors("email", "there is no account for this email address and registration isn't open")
+		return nil, nil
+	case signupDomainAllowlist:
+		if app.validateSignup(v, claims.Email); !v.Valid() {
+			return nil, nil
+		}
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+
+	user := &data.User{
+		Name:        name,
+		Email:       claims.Email,
+		Activated:   true,
+		Preferences: data.Preferences{},
+	}
+
+	// The user logs in through the provider, so give them a random password nobody knows. They
+	// can still set one later with the password reset flow.
+	err := setRandomPassword(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, nil
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
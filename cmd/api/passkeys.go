@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+	"github.com/mostafejur21/greenlight_go/internal/webauthn"
+)
+
+// How long the user has to finish a passkey registration or login
+const passkeyCeremonyTimeout = 5 * time.Minute
+
+// passkeyUserHandle() returns the WebAuthn user handle for a user, which authenticators store
+// with a discoverable passkey. It must not contain personal information, so it's just the id.
+func passkeyUserHandle(userId int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userId))
+}
+
+// The readPasskeyChallenge() helper parses the client data of a ceremony response and uses up
+// the challenge it answers, returning the user the challenge was issued to (nil for logins).
+// Problems the client can fix are added to the validator.
+func (app *application) readPasskeyChallenge(v *validator.Validator, clientDataJSON []byte) (*webauthn.ClientData, *int64, error) {
+	clientData, err := webauthn.ParseClientData(clientDataJSON)
+	if err != nil {
+		v.AddErrors("credential", "must be a valid passkey credential")
+		return nil, nil, nil
+	}
+
+	userId, err := app.models.Passkeys.ConsumeChallenge(clientData.Challenge)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("credential", "invalid or expired challenge")
+			return nil, nil, nil
+		default:
+			return nil, nil, err
+		}
+	}
+
+	return clientData, userId, nil
+}
+
+// The beginPasskeyRegistrationHandler starts registering a new passkey for the user, returning
+// the options to pass to navigator.credentials.create()
+func (app *application) beginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	passkeys, err := app.models.Passkeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// stop the user registering the same authenticator twice
+	var exclude [][]byte
+	for _, passkey := range passkeys {
+		exclude = append(exclude, passkey.CredentialID)
+	}
+
+	challenge, err := app.models.Passkeys.NewChallenge(&user.ID, passkeyCeremonyTimeout)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	options := app.webauthn.CreationOptions(challenge, passkeyUserHandle(user.ID), user.Email, user.Name, exclude, passkeyCeremonyTimeout)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"publicKey": options}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The finishPasskeyRegistrationHandler verifies the response of navigator.credentials.create()
+// and stores the new passkey. Binary values are base64url encoded, as in the browser's toJSON().
+func (app *application) finishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name       string `json:"name"`
+		Credential struct {
+			ID       string `json:"id"`
+			Response struct {
+				ClientDataJSON    string `json:"clientDataJSON"`
+				AttestationObject string `json:"attestationObject"`
+			} `json:"response"`
+		} `json:"credential"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	passkey := &data.Passkey{
+		UserID: user.ID,
+		Name:   input.Name,
+	}
+
+	v := validator.New()
+
+	clientDataJSON, err1 := webauthn.Encoding.DecodeString(input.Credential.Response.ClientDataJSON)
+	attestationObject, err2 := webauthn.Encoding.DecodeString(input.Credential.Response.AttestationObject)
+	v.Check(err1 == nil && err2 == nil, "credential", "must be a valid passkey credential")
+
+	if data.ValidatePasskey(v, passkey); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	clientData, userId, err := app.readPasskeyChallenge(v, clientDataJSON)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the challenge must have been issued to this user for a registration
+	if v.Valid() && (userId == nil || *userId != user.ID) {
+		v.AddErrors("credential", "invalid or expired challenge")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	credential, err := app.webauthn.VerifyRegistration(clientData, attestationObject)
+	if err != nil {
+		switch {
+		case errors.Is(err, webauthn.ErrUnsupportedAlgorithm):
+			v.AddErrors("credential", "uses an unsupported algorithm")
+		default:
+			v.AddErrors("credential", "could not be verified")
+		}
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if v.Check(input.Credential.ID == webauthn.Encoding.EncodeToString(credential.ID), "credential", "could not be verified"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	passkey.CredentialID = credential.ID
+	passkey.PublicKey = credential.PublicKey
+	passkey.SignCount = credential.SignCount
+
+	err = app.models.Passkeys.Insert(passkey)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateCredential):
+			v.AddErrors("credential", "this passkey is already registered")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"passkey": passkey}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	passkeys, err := app.models.Passkeys.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"passkeys": passkeys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Passkeys.DeleteForUser(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "passkey successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The beginPasskeyLoginHandler starts a passkey login, returning the options to pass to
+// navigator.credentials.get(). No email address is needed, the browser offers the user every
+// passkey they have for us.
+func (app *application) beginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	challenge, err := app.models.Passkeys.NewChallenge(nil, passkeyCeremonyTimeout)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	options := app.webauthn.RequestOptions(challenge, nil, passkeyCeremonyTimeout)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"publicKey": options}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The finishPasskeyLoginHandler verifies the response of navigator.credentials.get() and logs
+// the user in. Passkeys always require user verification (a PIN or biometric) on top of having
+// the authenticator, so users with two-factor authentication don't get a TOTP challenge.
+func (app *application) finishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Credential struct {
+			ID       string `json:"id"`
+			Response struct {
+				ClientDataJSON    string `json:"clientDataJSON"`
+				AuthenticatorData string `json:"authenticatorData"`
+				Signature         string `json:"signature"`
+				UserHandle        string `json:"userHandle"`
+			} `json:"response"`
+		} `json:"credential"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	credentialID, err1 := webauthn.Encoding.DecodeString(input.Credential.ID)
+	clientDataJSON, err2 := webauthn.Encoding.DecodeString(input.Credential.Response.ClientDataJSON)
+	authenticatorData, err3 := webauthn.Encoding.DecodeString(input.Credential.Response.AuthenticatorData)
+	signature, err4 := webauthn.Encoding.DecodeString(input.Credential.Response.Signature)
+	userHandle, err5 := webauthn.Encoding.DecodeString(input.Credential.Response.UserHandle)
+
+	if v.Check(errors.Join(err1, err2, err3, err4, err5) == nil && len(credentialID) > 0, "credential", "must be a valid passkey credential"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	clientData, userId, err := app.readPasskeyChallenge(v, clientDataJSON)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// registration challenges can't be used to log in
+	if v.Valid() && userId != nil {
+		v.AddErrors("credential", "invalid or expired challenge")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	passkey, err := app.models.Passkeys.GetForCredentialID(credentialID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// a discoverable passkey also tells us whose it is, which has to agree with our records
+	if len(userHandle) > 0 && !bytes.Equal(userHandle, passkeyUserHandle(passkey.UserID)) {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	signCount, err := app.webauthn.VerifyAssertion(clientData, authenticatorData, signature, passkey.PublicKey, passkey.SignCount)
+	if err != nil {
+		if errors.Is(err, webauthn.ErrClonedAuthenticator) {
+			app.logger.Warn("passkey signature counter went backwards, the authenticator may have been cloned", "passkey_id", passkey.ID, "user_id", passkey.UserID)
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(passkey.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Like the other logins, a disabled account is only turned away once the user has proved who
+	// they are, and before the passkey is marked as used. An account scheduled for deletion can
+	// still log in, since that's how the user cancels the deletion.
+	if user.IsDisabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	err = app.models.Passkeys.Use(passkey, signCount)
+	if err != nil {
+		switch {
+		// another login with the same counter value got there first
+		case errors.Is(err, data.ErrEditConflict):
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.createSessionResponse(w, r, user)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+)
+
+// A movieRule decides whether a user may perform an action on a specific movie. hasPermission
+// reports whether the user can use a permission for this request. requirePermission() only
+// checks that a user may perform an action at all, rules check it for one record.
+type movieRule func(user *data.User, hasPermission func(code string) bool, movie *data.Movie) bool
+
+// canEditMovie allows the user who added a movie to edit it, and moderators to edit any movie
+func canEditMovie(user *data.User, hasPermission func(code string) bool, movie *data.Movie) bool {
+	if movie.CreatedBy != nil && *movie.CreatedBy == user.ID {
+		return true
+	}
+	return hasPermission("movies:moderate")
+}
+
+// canDeleteMovie only allows movie admins to delete movies, including their own
+func canDeleteMovie(user *data.User, hasPermission func(code string) bool, movie *data.Movie) bool {
+	return hasPermission("movies:admin")
+}
+
+// The authorizeMovie() method evaluates a rule for the user making the request. Like in
+// requirePermission(), a request made with an API key can only use the permissions the key was
+// given.
+func (app *application) authorizeMovie(r *http.Request, movie *data.Movie, rule movieRule) (bool, error) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.userPermissions(user.ID)
+	if err != nil {
+		return false, err
+	}
+
+	key := app.contextGetAPIKey(r)
+
+	hasPermission := func(code string) bool {
+		return permissions.Include(code) && (key == nil || key.Permissions.Include(code))
+	}
+
+	return rule(user, hasPermission, movie), nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	role := &data.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: input.Permissions,
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateRole(v, role, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.Insert(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddErrors("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	role, err := app.models.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	role, err := app.models.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Name        *string  `json:"name"`
+		Description *string  `json:"description"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		role.Name = *input.Name
+	}
+	if input.Description != nil {
+		role.Description = *input.Description
+	}
+	if input.Permissions != nil {
+		role.Permissions = input.Permissions
+	}
+
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateRole(v, role, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.Update(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddErrors("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// every user with the role is affected
+	app.invalidatePermissions()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Roles.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidatePermissions()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) assignUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	var input struct {
+		Roles []string `json:"roles"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	known := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		known[role.Name] = true
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Roles) > 0, "roles", "must contain at least 1 role")
+	v.Check(validator.Unique(input.Roles), "roles", "must not contain duplicate values")
+	for _, name := range input.Roles {
+		v.Check(known[name], "roles", "must only contain existing role names")
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Roles.AddForUser(user.ID, input.Roles...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidateUser(user.ID)
+
+	app.writeUserRoles(w, r, user)
+}
+
+func (app *application) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+
+	name := httprouter.ParamsFromContext(r.Context()).ByName("role")
+
+	err := app.models.Roles.RemoveForUser(user.ID, name)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.invalidateUser(user.ID)
+
+	app.writeUserRoles(w, r, user)
+}
+
+// The writeUserRoles() helper responds with the user's roles and the effective permissions
+// they result in, after the roles were changed
+func (app *application) writeUserRoles(w http.ResponseWriter, r *http.Request, user *data.User) {
+	roles, err := app.models.Roles.GetNamesForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles, "permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -26,9 +26,69 @@ func (app *application) routes() http.Handler {
 	// User routes
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireInteractiveSession(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireInteractiveSession(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireInteractiveSession(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/deletion", app.requireInteractiveSession(app.cancelAccountDeletionHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/export", app.requireInteractiveSession(app.exportCurrentUserHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireInteractiveSession(app.changeCurrentUserPasswordHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/email", app.requireActivatedUser(app.requireInteractiveSession(app.requestEmailChangeHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/sessions", app.requireInteractiveSession(app.listSessionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/sessions/:id", app.requireInteractiveSession(app.deleteSessionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireActivatedUser(app.requireInteractiveSession(app.enrollTOTPHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp", app.requireActivatedUser(app.requireInteractiveSession(app.confirmTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireActivatedUser(app.requireInteractiveSession(app.disableTOTPHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/passkeys", app.requireInteractiveSession(app.listPasskeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/passkeys/registration", app.requireActivatedUser(app.requireInteractiveSession(app.beginPasskeyRegistrationHandler)))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/passkeys/registration", app.requireActivatedUser(app.requireInteractiveSession(app.finishPasskeyRegistrationHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/passkeys/:id", app.requireInteractiveSession(app.deletePasskeyHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireInteractiveSession(app.listAPIKeysHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/api-keys", app.requireActivatedUser(app.requireInteractiveSession(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/api-keys/:id", app.requireActivatedUser(app.requireInteractiveSession(app.deleteAPIKeyHandler)))
+
+	// Admin routes
+	router.HandlerFunc(http.MethodPost, "/v1/admin/unlock", app.requirePermission("users:admin", app.unlockLoginHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("users:admin", app.updateUserStatusHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/password-reset", app.requirePermission("users:admin", app.resetUserPasswordHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/sessions", app.requirePermission("users:admin", app.revokeUserSessionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.revokeUserPermissionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("users:admin", app.assignUserRolesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission("users:admin", app.removeUserRoleHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/invitations", app.requirePermission("users:admin", app.listInvitationsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/invitations", app.requirePermission("users:admin", app.createInvitationHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/invitations/:id", app.requirePermission("users:admin", app.deleteInvitationHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("users:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/roles", app.requirePermission("users:admin", app.createRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles/:id", app.requirePermission("users:admin", app.showRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/roles/:id", app.requirePermission("users:admin", app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/roles/:id", app.requirePermission("users:admin", app.deleteRoleHandler))
 
 	// token create for user
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireInteractiveSession(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireInteractiveSession(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/oidc/:provider", app.startOIDCLoginHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/oidc/:provider/callback", app.oidcCallbackHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/totp", app.createTOTPAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/passkey", app.beginPasskeyLoginHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/tokens/passkey", app.finishPasskeyLoginHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/tokens/magic-link", app.exchangeMagicLinkTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/introspect", app.requirePermission("tokens:introspect", app.introspectTokenHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+
+	// application metrics, like the auth cache hit and miss counts
+	router.HandlerFunc(http.MethodGet, "/debug/vars", app.requirePermission("users:admin", app.metricsHandler))
+
 	// return the http router instance
-	return app.recoverPanic(app.rateLimiter(app.authenticate(router)))
+	return app.recoverPanic(app.rateLimiter(app.authenticate(app.idempotency(router))))
 }
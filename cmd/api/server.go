@@ -45,6 +45,9 @@ func (app *application) serve() error {
         }
         app.logger.Info("completing background tasks", "addr", srv.Addr)
 
+        // tell the maintenance scheduler to stop once its current run is done
+        close(app.shutdown)
+
         // wait for the waitgroup
         app.wg.Wait()
         // Call Shutdown() function on our server, passing the context we just made.
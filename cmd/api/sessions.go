@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+)
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	// Retrive every active session for the user, marking the one used for this request
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Revoke the session, sending a 404 if it doesn't exist or belongs to somebody else
+	err = app.revokeSession(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/jwt"
+)
+
+// denylistCache is the in-memory copy of the revoked signed tokens. Checking it doesn't need a
+// database round trip, which is the whole point of signed tokens. It is reloaded from the
+// database regularly so revocations made by other instances of the API are picked up too.
+type denylistCache struct {
+	mu   sync.RWMutex
+	list *data.Denylist
+}
+
+// The loadDenylist() method replaces the cached denylist with the current one from the database
+func (app *application) loadDenylist() error {
+	list, err := app.models.Denylist.GetActive()
+	if err != nil {
+		return err
+	}
+
+	app.denylist.mu.Lock()
+	app.denylist.list = list
+	app.denylist.mu.Unlock()
+
+	return nil
+}
+
+// The refreshDenylist() method reloads the denylist in the background, once every interval
+func (app *application) refreshDenylist() {
+	go func() {
+		for {
+			time.Sleep(app.config.auth.denylistRefresh)
+
+			err := app.loadDenylist()
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		}
+	}()
+}
+
+// isDenied() reports whether a signed token has been revoked, either on its own, along with the
+// rest of its session, or because all of the user's tokens were revoked after it was issued
+func (app *application) isDenied(claims *jwt.Claims) bool {
+	app.denylist.mu.RLock()
+	defer app.denylist.mu.RUnlock()
+
+	if app.denylist.list == nil {
+		return false
+	}
+
+	if _, found := app.denylist.list.Tokens[claims.ID]; found {
+		return true
+	}
+
+	if _, found := app.denylist.list.Families[claims.Family]; found && claims.Family != "" {
+		return true
+	}
+
+	revokedAt, found := app.denylist.list.Users[claims.Subject]
+	return found && claims.IssuedAt <= revokedAt.Unix()
+}
+
+// The issueSignedToken() method creates a signed authentication token for the user, which is
+// part of the given token family so logging out also revokes the session's refresh token
+func (app *application) issueSignedToken(user *data.User, family string) (*data.Token, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.auth.accessTokenTTL)
+
+	// isDenied() compares whole seconds, so a token issued in the same second the user's
+	// tokens were revoked would be rejected straight away. Issue it just after the cutoff.
+	issuedAt := now.Unix()
+	app.denylist.mu.RLock()
+	if app.denylist.list != nil {
+		if revokedAt, found := app.denylist.list.Users[user.ID]; found && issuedAt <= revokedAt.Unix() {
+			issuedAt = revokedAt.Unix() + 1
+		}
+	}
+	app.denylist.mu.RUnlock()
+
+	claims := jwt.Claims{
+		ID:        base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes),
+		Subject:   user.ID,
+		Scope:     data.ScopeAuthentication,
+		Activated: user.Activated,
+		Family:    family,
+		IssuedAt:  issuedAt,
+		ExpiresAt: expiry.Unix(),
+	}
+
+	plaintext, err := app.signer.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Token{
+		Plaintext: plaintext,
+		UserId:    user.ID,
+		Expiry:    time.Unix(claims.ExpiresAt, 0),
+		Scope:     data.ScopeAuthentication,
+		Family:    family,
+	}, nil
+}
+
+// The revokeToken() method revokes the authentication token the request was made with, and
+// the rest of its session
+func (app *application) revokeToken(r *http.Request) error {
+	token := app.contextGetToken(r)
+
+	defer app.invalidateUser(app.contextGetUser(r).ID)
+
+	if app.signer == nil || !jwt.LooksSigned(token) {
+		return app.models.Tokens.DeleteForPlaintext(data.ScopeAuthentication, token)
+	}
+
+	claims, err := app.signer.Verify(token, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Denylist.DenyToken(claims.ID, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return err
+	}
+
+	app.denylist.mu.Lock()
+	if app.denylist.list != nil {
+		app.denylist.list.Tokens[claims.ID] = time.Unix(claims.ExpiresAt, 0)
+	}
+	app.denylist.mu.Unlock()
+
+	return app.models.Tokens.DeleteFamily(claims.Family, claims.Subject)
+}
+
+// The revokeSession() method revokes one of the user's sessions, identified by the id of its
+// refresh token. Its signed tokens aren't stored, so the session's family is denied instead.
+func (app *application) revokeSession(userID, id int64) error {
+	family, err := app.models.Tokens.DeleteForUser(data.ScopeRefresh, id, userID)
+	if err != nil {
+		return err
+	}
+
+	app.invalidateUser(userID)
+
+	if app.signer == nil || family == "" {
+		return nil
+	}
+
+	// No signed token lives longer than accessTokenTTL, so the entry can go after that
+	expiry := time.Now().Add(app.config.auth.accessTokenTTL)
+
+	err = app.models.Denylist.DenyFamily(family, expiry)
+	if err != nil {
+		return err
+	}
+
+	app.denylist.mu.Lock()
+	if app.denylist.list != nil {
+		app.denylist.list.Families[family] = expiry
+	}
+	app.denylist.mu.Unlock()
+
+	return nil
+}
+
+// The revokeAllSessions() method logs a user out everywhere, revoking their opaque tokens and
+// any signed tokens they have been issued
+func (app *application) revokeAllSessions(userID int64) error {
+	err := app.models.Tokens.DeleteAllSessionsForUser(userID)
+	if err != nil {
+		return err
+	}
+
+	app.invalidateUser(userID)
+
+	if app.signer == nil {
+		return nil
+	}
+
+	// No signed token lives longer than accessTokenTTL, so the entry can go after that
+	revokedAt, err := app.models.Denylist.DenyUser(userID, time.Now().Add(app.config.auth.accessTokenTTL))
+	if err != nil {
+		return err
+	}
+
+	app.denylist.mu.Lock()
+	if app.denylist.list != nil {
+		app.denylist.list.Users[userID] = revokedAt
+	}
+	app.denylist.mu.Unlock()
+
+	return nil
+}
+
+// The revokeOtherSessions() method logs a user out everywhere except the session the request
+// was made with. Signed tokens can only be revoked all at once, so in that case a fresh token
+// for the current session is returned for the client to use from now on.
+func (app *application) revokeOtherSessions(r *http.Request, user *data.User) (*data.Token, error) {
+	token := app.contextGetToken(r)
+
+	// Requests made with an API key don't belong to a session, so there is nothing to keep
+	if token == "" {
+		return nil, app.revokeAllSessions(user.ID)
+	}
+
+	defer app.invalidateUser(user.ID)
+
+	if app.signer == nil || !jwt.LooksSigned(token) {
+		return nil, app.models.Tokens.DeleteOtherSessionsForUser(user.ID, token, "")
+	}
+
+	claims, err := app.signer.Verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Tokens.DeleteOtherSessionsForUser(user.ID, token, claims.Family)
+	if err != nil {
+		return nil, err
+	}
+
+	revokedAt, err := app.models.Denylist.DenyUser(user.ID, time.Now().Add(app.config.auth.accessTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	app.denylist.mu.Lock()
+	if app.denylist.list != nil {
+		app.denylist.list.Users[user.ID] = revokedAt
+	}
+	app.denylist.mu.Unlock()
+
+	return app.issueSignedToken(user, claims.Family)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// keyedLimiter keeps a token bucket rate limiter per key (an IP address, an email address
+// etc). It works the same way as the rateLimiter() middleware, but can be used from inside
+// a handler once we know what the key should be.
+type keyedLimiter struct {
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*keyedLimiterClient
+}
+
+type keyedLimiterClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newKeyedLimiter() returns a keyedLimiter which allows burst events straight away and then
+// refills at the given limit. It also launches a background goroutine which removes keys
+// that have not been seen for long enough that their bucket would be full again anyway.
+func newKeyedLimiter(limit rate.Limit, burst int) *keyedLimiter {
+	l := &keyedLimiter{
+		limit:   limit,
+		burst:   burst,
+		clients: make(map[string]*keyedLimiterClient),
+	}
+
+	refill := time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			l.mu.Lock()
+			for key, client := range l.clients {
+				if time.Since(client.lastSeen) > refill {
+					delete(l.clients, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+
+	return l
+}
+
+// Allow() reports whether an event for the key may happen now.
+func (l *keyedLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, found := l.clients[key]; !found {
+		l.clients[key] = &keyedLimiterClient{
+			limiter: rate.NewLimiter(l.limit, l.burst),
+		}
+	}
+
+	l.clients[key].lastSeen = time.Now()
+
+	return l.clients[key].limiter.Allow()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/mostafejur21/greenlight_go/internal/data"
@@ -29,12 +30,42 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Refuse straight away if there have been too many failed logins for this email address or
+	// from this IP address. This is checked for unknown email addresses too, so the response
+	// doesn't give away whether the address has an account
+	wait, err := app.checkLoginThrottle(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, ceilSeconds(wait))
+		return
+	}
+
+	// Count the attempt before the slow password check, and check the counts again, so parallel
+	// attempts only get as many guesses as sequential ones
+	failure, wait, err := app.recordLoginAttempt(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if wait > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, ceilSeconds(wait))
+		return
 	}
 
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			// take as long as a wrong password would
+			data.SimulatePasswordCheck(input.Password)
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -52,22 +83,393 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	// if the password don't match
 	if !match {
+		app.loginFailed(user, failure)
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	// if the password match, then we generate the new token with 24 hour expiry time
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	err = app.loginSucceeded(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Now that we know the password, replace a hash made with an old algorithm or old parameters.
+	// The login doesn't depend on it, so failures are only logged and it is tried again next time
+	if user.Password.Outdated() {
+		app.rehashPassword(user, input.Password)
+	}
+
+	// if the password match, then we log the user in
+	app.completeLogin(w, r, user)
+}
+
+// The rehashPassword() method hashes a user's password again with the current password hasher
+func (app *application) rehashPassword(user *data.User, plaintext string) {
+	err := user.Password.Set(plaintext)
+	if err == nil {
+		err = app.models.Users.Update(user)
+	}
+
+	// a conflict means the user was changed at the same time, so leave it for the next login
+	if err != nil && !errors.Is(err, data.ErrEditConflict) {
+		app.logger.Error(err.Error(), "user_id", user.ID)
+	}
+}
+
+// The completeLogin() helper is called once a user has proved who they are. Users with
+// two-factor authentication get a short-lived challenge token, which they exchange for an
+// authentication token along with a TOTP code. Everyone else gets a new session straight away.
+// Disabled accounts are only turned away here, once the user has proved who they are, so the
+// response doesn't give away which accounts are disabled.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if user.IsDisabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	enabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enabled {
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeTOTPChallenge)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"totp-challenge-token": token}, noStore())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.createSessionResponse(w, r, user)
+}
+
+// The createSessionResponse() helper issues a new authentication token and refresh token for
+// the user and sends them to the client with a 201 Created status code. In signed auth mode
+// the authentication token is a signed token instead of an opaque one. Every login ends up
+// here, so disabled accounts are checked again in case the caller didn't.
+func (app *application) createSessionResponse(w http.ResponseWriter, r *http.Request, user *data.User) {
+	if user.IsDisabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	if app.config.auth.mode != "signed" {
+		token, refreshToken, err := app.models.Tokens.NewSession(user.ID, app.config.auth.accessTokenTTL, app.config.auth.refreshTokenTTL, app.clientIP(r), r.UserAgent())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.sessionTokensResponse(w, r, token, refreshToken)
+		return
+	}
+
+	_, refreshToken, err := app.models.Tokens.NewSession(user.ID, 0, app.config.auth.refreshTokenTTL, app.clientIP(r), r.UserAgent())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.issueSignedToken(user, refreshToken.Family)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sessionTokensResponse(w, r, token, refreshToken)
+}
+
+// The sessionTokensResponse() helper sends an authentication and refresh token pair to the client.
+// Clients using a cookie session get the tokens as cookies, and only the CSRF token in the body.
+func (app *application) sessionTokensResponse(w http.ResponseWriter, r *http.Request, token, refreshToken *data.Token) {
+	if app.wantsCookieSession(r) {
+		csrfToken := app.setSessionCookies(w, token, refreshToken)
+
+		err := app.writeJSON(w, http.StatusCreated, envelope{"csrf-token": csrfToken, "expiry": token.Expiry}, noStore())
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Encode the tokens to JSON and send it in the response along with a 201 Created status code
+	err := app.writeJSON(w, http.StatusCreated, envelope{"authentication-token": token, "refresh-token": refreshToken}, noStore())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// parse the refresh token from the request body
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	// Cookie sessions keep the refresh token in a cookie which is only sent to this endpoint. It
+	// is SameSite=Strict, so other sites can't make the browser refresh the session.
+	if cookie, err := r.Cookie(refreshCookieName); err == nil {
+		input.TokenPlaintext = cookie.Value
+		r = app.contextSetCookieSession(r)
+	} else {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestRespons(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// In signed mode the authentication token is issued below instead of by Rotate()
+	accessTTL := app.config.auth.accessTokenTTL
+	if app.config.auth.mode == "signed" {
+		accessTTL = 0
+	}
+
+	// Exchange the refresh token for a new pair of tokens
+	token, refreshToken, err := app.models.Tokens.Rotate(input.TokenPlaintext, accessTTL, app.config.auth.refreshTokenTTL, app.clientIP(r), r.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			if app.contextIsCookieSession(r) {
+				app.clearSessionCookies(w)
+			}
+			v.AddErrors("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		// An already rotated token was used again, the whole token family has been revoked
+		case errors.Is(err, data.ErrTokenReused):
+			app.logger.Warn("refresh token reuse detected, token family revoked", "ip", app.clientIP(r))
+			// we don't know whose family it was, and this is rare enough to just drop every cached token
+			app.authCache.tokens.Clear()
+			if app.contextIsCookieSession(r) {
+				app.clearSessionCookies(w)
+			}
+			v.AddErrors("token", "invalid or expired refresh token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Rotate() deleted the family's previous authentication token
+	app.invalidateUser(refreshToken.UserId)
+
+	if token == nil {
+		// the signed token carries the activation status, so get the current one
+		user, err := app.models.Users.Get(refreshToken.UserId)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		token, err = app.issueSignedToken(user, refreshToken.Family)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	app.sessionTokensResponse(w, r, token, refreshToken)
+}
+
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// parse and validate the user's email address
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Throttle by the client's IP address and by the email address, so this endpoint can't be
+	// used to flood somebody's inbox. Every address is throttled the same, whether or not it has
+	// an account.
+	if !app.throttles.resetIP.Allow(app.clientIP(r)) || !app.throttles.resetEmail.Allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	// Look up the user and send the email in the background. The client always gets the same
+	// response (and roughly the same response time), so this endpoint can't be used to find out
+	// which email addresses have an account
+	app.background(func() {
+		user, err := app.models.Users.GetByEmail(input.Email)
+		if err != nil {
+			if !errors.Is(err, data.ErrRecordNotFound) {
+				app.logger.Error(err.Error())
+			}
+			return
+		}
+
+		// only activated accounts can reset their password, and disabled ones can't at all
+		if !user.Activated || user.IsDisabled() {
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+
+		data := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{"message": "if an account with that email address exists, you will receive an email with password reset instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// parse and validate the user's email address
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Throttle by the client's IP address and by the email address, so this endpoint can't be
+	// used to flood somebody's inbox
+	if !app.throttles.activationIP.Allow(app.clientIP(r)) || !app.throttles.activationEmail.Allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("email", "no matching email address found")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.IsDisabled() {
+		app.accountDisabledResponse(w, r)
+		return
+	}
+
+	if user.Activated {
+		v.AddErrors("email", "user has already been activated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Invalidate any activation tokens sent earlier, only the newest one should work
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]any{
+			"activationToken": token.Plaintext,
+		}
+
+		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAuthenticationTokenHandler() logs the client out by revoking the token it used to
+// authenticate this request
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.revokeToken(r)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// Encode the token to JSON and send it in the response along with a 201 Created status code
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication-token": token}, nil)
+	if app.contextIsCookieSession(r) {
+		app.clearSessionCookies(w)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteAllAuthenticationTokensHandler() logs the user out everywhere
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.revokeAllSessions(user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	if app.contextIsCookieSession(r) {
+		app.clearSessionCookies(w)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "all of your sessions have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/data"
+	"github.com/mostafejur21/greenlight_go/internal/totp"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// enrollTOTPHandler() starts two-factor enrollment. It generates a new secret and returns it,
+// along with the otpauth:// URI for authenticator apps. 2FA isn't enabled until the user
+// confirms it with a first code.
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.SetPending(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v := validator.New()
+			v.AddErrors("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"totp": map[string]string{
+		"secret": secret,
+		"uri":    totp.URI(app.config.totp.issuer, user.Email, secret),
+	}}
+
+	err = app.writeJSON(w, http.StatusCreated, env, noStore())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmTOTPHandler() enables two-factor authentication once the user proves their
+// authenticator app works, and returns the recovery codes. This is the only time the recovery
+// codes are shown.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	secret, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("code", "two-factor enrollment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if secret.Confirmed {
+		v.AddErrors("code", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, ok, err := totp.Validate(secret.Secret, input.Code, time.Now())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		v.AddErrors("code", "invalid two-factor authentication code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	codes, err := app.models.TOTP.Confirm(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, noStore())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTOTPHandler() turns two-factor authentication off, after checking the user's password
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidatePasswordPlainText(v, input.Password); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication has been disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createTOTPAuthenticationTokenHandler() is the second step of logging in with two-factor
+// authentication. It exchanges the challenge token returned by createAuthenticationTokenHandler()
+// and a TOTP or recovery code for a normal authentication token.
+func (app *application) createTOTPAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	switch {
+	case input.RecoveryCode != "":
+		data.ValidateRecoveryCode(v, input.RecoveryCode)
+	default:
+		data.ValidateTOTPCode(v, input.Code)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeTOTPChallenge, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("token", "invalid or expired two-factor challenge token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// There are only a million codes, so limit the guesses per user
+	if !app.throttles.totp.Allow(strconv.FormatInt(user.ID, 10)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	var ok bool
+
+	if input.RecoveryCode != "" {
+		ok, err = app.models.TOTP.UseRecoveryCode(user.ID, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		ok, err = app.checkTOTPCode(user.ID, input.Code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	if !ok {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	// The challenge has been answered, so it can't be used again
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeTOTPChallenge, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.createSessionResponse(w, r, user)
+}
+
+// The checkTOTPCode() helper reports whether code is a valid, unused TOTP code for the user
+func (app *application) checkTOTPCode(userID int64, code string) (bool, error) {
+	secret, err := app.models.TOTP.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	if !secret.Confirmed {
+		return false, nil
+	}
+
+	step, ok, err := totp.Validate(secret.Secret, code, time.Now())
+	if err != nil || !ok {
+		return false, err
+	}
+
+	// refuse a code that has been used before
+	return app.models.TOTP.UseStep(userID, step)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/mostafejur21/greenlight_go/internal/data"
@@ -12,9 +13,16 @@ import (
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Create an anonymous struct to hold the expected data from the request body.
 	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"Password"`
+		Name        string `json:"name"`
+		Email       string `json:"email"`
+		Password    string `json:"Password"`
+		InviteToken string `json:"invite_token"`
+	}
+
+	// Nobody can register in the closed signup mode, not even with an invitation
+	if app.config.signup.mode == signupClosed {
+		app.registrationClosedResponse(w, r)
+		return
 	}
 
 	// Parse the request body into the struct
@@ -25,9 +33,40 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	user := &data.User{
-		Name:      input.Name,
-		Email:     input.Email,
-		Activated: false,
+		Name:        input.Name,
+		Email:       input.Email,
+		Activated:   false,
+		Preferences: data.Preferences{},
+	}
+
+	v := validator.New()
+
+	// Validate the password before hashing it, hashing is slow on purpose
+	data.ValidatePasswordPlainText(v, input.Password)
+	app.validatePasswordPolicy(v, input.Password, user)
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// An invitation lets the user register whatever the signup mode is, otherwise the mode
+	// decides whether they can
+	var invitation *data.Invitation
+
+	if input.InviteToken != "" {
+		invitation, err = app.readInvitation(v, input.InviteToken, user.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	} else {
+		app.validateSignup(v, user.Email)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 
 	// Use the Password.Set() method to generate and store the hashed and plaintext password
@@ -37,9 +76,8 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	v := validator.New()
-	if data.ValidateUser(v, user); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	if invitation != nil {
+		app.registerInvitedUser(w, r, v, user, invitation)
 		return
 	}
 
@@ -111,6 +149,35 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// The registerInvitedUser() helper creates the account for a registration with an invitation.
+// The invitation was sent to the user's email address, which proves they own it, so the account
+// is activated straight away and doesn't need an activation token. The invitation is used up in
+// the same transaction as the account is created, so it can only ever create one account and
+// isn't lost if creating it fails.
+func (app *application) registerInvitedUser(w http.ResponseWriter, r *http.Request, v *validator.Validator, user *data.User, invitation *data.Invitation) {
+	user.Activated = true
+
+	err := app.models.Invitations.Accept(invitation, user, "movies:read")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			v.AddErrors("invite_token", "invalid or expired invitation token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddErrors("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the plaintext token from the request body
 	var input struct {
@@ -162,6 +229,9 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Any session the user already has should see the new activation status
+	app.invalidateUser(user.ID)
+
 	// Deleting all activation tokens for the user
 	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
 	if err != nil {
@@ -174,3 +244,415 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse the new password and the password reset token
+	var input struct {
+		Password       string `json:"password"`
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidatePasswordPlainText(v, input.Password)
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Retrive the user for the password reset token
+	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("token", "invalid or expired password reset token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.validatePasswordPolicy(v, input.Password, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Set the new password for the user
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Delete all the password reset tokens, and revoke every authentication token so any
+	// session using the old password is logged out
+	err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.revokeAllSessions(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "your password was successfully reset"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// requestEmailChangeHandler() starts changing the authenticated user's email address. The new
+// address is stored as pending and gets a confirmation token, and the old address gets a
+// notice. users.email only changes once the new address is confirmed.
+func (app *application) requestEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateEmail(v, input.Email)
+	data.ValidatePasswordPlainText(v, input.Password)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Changing the email address is as good as taking over the account, so check the password
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if strings.EqualFold(input.Email, user.Email) {
+		v.AddErrors("email", "must be different from your current email address")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(input.Email)
+	switch {
+	case err == nil:
+		v.AddErrors("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.SetPendingEmail(user.ID, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Only the token for the latest pending address should work
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeEmailChange, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeEmailChange)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		err := app.mailer.Send(input.Email, "email_change_confirm.tmpl", map[string]any{
+			"emailChangeToken": token.Plaintext,
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+
+		err = app.mailer.Send(user.Email, "email_change_notice.tmpl", map[string]any{
+			"newEmail": input.Email,
+		})
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	})
+
+	env := envelope{"message": "an email will be sent to the new address containing confirmation instructions"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// confirmEmailChangeHandler() swaps the user's email address for the pending one, using the
+// token which was sent to the new address
+func (app *application) confirmEmailChangeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeEmailChange, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Users.ConfirmEmailChange(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddErrors("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		// somebody registered the address after the change was requested
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddErrors("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidateUser(user.ID)
+
+	// Tokens sent to the old address shouldn't work any more
+	for _, scope := range []string{data.ScopeEmailChange, data.ScopePasswordReset, data.ScopeMagicLink} {
+		err = app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	user, err = app.models.Users.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Preferences are merged into the existing ones, and a key set to null is removed
+	var input struct {
+		Name        *string        `json:"name"`
+		Preferences map[string]any `json:"preferences"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	if input.Name != nil {
+		user.Name = *input.Name
+	}
+
+	if user.Preferences == nil {
+		user.Preferences = data.Preferences{}
+	}
+
+	for key, value := range input.Preferences {
+		if value == nil {
+			delete(user.Preferences, key)
+			continue
+		}
+		user.Preferences[key] = value
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.invalidateUser(user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) changeCurrentUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestRespons(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+	data.ValidatePasswordPlainText(v, input.NewPassword)
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.loadCurrentUser(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	match, err := user.Password.Matches(input.CurrentPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	if app.validatePasswordPolicy(v, input.NewPassword, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.NewPassword)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Anyone else who was logged in with the old password is logged out, but the client that
+	// made the change keeps its session
+	token, err := app.revokeOtherSessions(r, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "your password was successfully changed"}
+	switch {
+	case token != nil && app.contextIsCookieSession(r):
+		env["csrf-token"] = app.setSessionCookies(w, token, nil)
+	case token != nil:
+		env["authentication-token"] = token
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, noStore())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -2,12 +2,15 @@ module github.com/mostafejur21/greenlight_go
 
 go 1.23.3
 
-require github.com/julienschmidt/httprouter v1.3.0
+require (
+	github.com/go-mail/mail/v2 v2.3.0
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.33.0
+	golang.org/x/time v0.9.0
+)
 
 require (
-	github.com/go-mail/mail/v2 v2.3.0 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	golang.org/x/crypto v0.33.0 // indirect
-	golang.org/x/time v0.9.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 )
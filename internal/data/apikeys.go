@@ -0,0 +1,253 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// All API keys start with this prefix, which makes them easy to spot in logs and config files
+const apiKeyPrefix = "gl_"
+
+// APIKey is a long-lived credential for machine clients. It acts on behalf of the user who
+// created it, but only with the permissions it was given. Plaintext is only set when the key
+// has just been created, we only store the hash.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Prefix      string      `json:"prefix"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// generateAPIKey() fills in the plaintext, display prefix and hash of a new key
+func generateAPIKey(key *APIKey) error {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	key.Plaintext = apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	key.Prefix = key.Plaintext[:len(apiKeyPrefix)+8]
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return nil
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// Validate plaintext API key provided by the client
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(plaintext != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(plaintext, apiKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(plaintext) == len(apiKeyPrefix)+52, "key", "must be a valid API key")
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// The New() method generates a new key for the user and inserts it
+func (m APIKeyModel) New(key *APIKey) error {
+	err := generateAPIKey(key)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO api_keys (user_id, name, prefix, hash, permissions, expiry)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at`
+
+	args := []any{key.UserID, key.Name, key.Prefix, key.Hash, pq.Array(key.Permissions), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// The GetAllForUser() method returns every key of the user, newest first
+func (m APIKeyModel) GetAllForUser(userId int64) ([]*APIKey, error) {
+	query := `
+        SELECT id, user_id, name, prefix, permissions, created_at, expiry, last_used_at
+        FROM api_keys
+        WHERE user_id = $1
+        ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(
+			&key.ID,
+			&key.UserID,
+			&key.Name,
+			&key.Prefix,
+			pq.Array(&key.Permissions),
+			&key.CreatedAt,
+			&key.Expiry,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// The GetForPlaintext() method returns an unexpired key together with the user who owns it. The
+// keys of disabled accounts are treated as if they don't exist.
+func (m APIKeyModel) GetForPlaintext(plaintext string) (*APIKey, *User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+        SELECT api_keys.id, api_keys.name, api_keys.prefix, api_keys.permissions, api_keys.created_at,
+            api_keys.expiry, api_keys.last_used_at,
+            users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.preferences, users.deletion_scheduled_at, users.disabled_at, users.version
+        FROM api_keys
+        INNER JOIN users ON users.id = api_keys.user_id
+        WHERE api_keys.hash = $1
+        AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+        AND users.disabled_at IS NULL`
+
+	var (
+		key  APIKey
+		user User
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&key.ID,
+		&key.Name,
+		&key.Prefix,
+		pq.Array(&key.Permissions),
+		&key.CreatedAt,
+		&key.Expiry,
+		&key.LastUsedAt,
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Preferences,
+		&user.DeletionScheduledAt,
+		&user.DisabledAt,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+
+	return &key, &user, nil
+}
+
+// Touch() records that a key has just been used, at most once a minute like TokenModel.Touch()
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+        UPDATE api_keys
+        SET last_used_at = NOW()
+        WHERE id = $1
+        AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// The DeleteForUser() method revokes one of the user's keys
+func (m APIKeyModel) DeleteForUser(id, userId int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// The DeleteAllForUser() method revokes every key of the user
+func (m APIKeyModel) DeleteAllForUser(userId int64) error {
+	query := `
+        DELETE FROM api_keys
+        WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userId)
+	return err
+}
@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Denylist holds the revocations for signed authentication tokens which haven't expired yet.
+// Tokens holds individual token ids (the jti claim), Families holds revoked sessions (the fam
+// claim) and Users holds, for each user, the time before which all of their signed tokens are
+// revoked.
+type Denylist struct {
+	Tokens   map[string]time.Time
+	Families map[string]time.Time
+	Users    map[int64]time.Time
+}
+
+// Define the DenylistModel type.
+type DenylistModel struct {
+	DB *sql.DB
+}
+
+// DenyToken() revokes a single signed token until it would have expired anyway
+func (m DenylistModel) DenyToken(jti string, expiry time.Time) error {
+	query := `
+        INSERT INTO token_denylist (jti, expiry)
+        VALUES ($1, $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, jti, expiry)
+	return err
+}
+
+// DenyFamily() revokes every signed token issued to a session, until the last of them would have
+// expired anyway
+func (m DenylistModel) DenyFamily(family string, expiry time.Time) error {
+	query := `
+        INSERT INTO token_denylist (family, expiry)
+        VALUES ($1, $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family, expiry)
+	return err
+}
+
+// DenyUser() revokes every signed token issued to a user up to now. The entry is kept until
+// expiry, which should be the longest lifetime a signed token can have.
+func (m DenylistModel) DenyUser(userId int64, expiry time.Time) (time.Time, error) {
+	query := `
+        INSERT INTO token_denylist (user_id, expiry)
+        VALUES ($1, $2)
+        RETURNING revoked_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var revokedAt time.Time
+	err := m.DB.QueryRowContext(ctx, query, userId, expiry).Scan(&revokedAt)
+	return revokedAt, err
+}
+
+// GetActive() returns all of the unexpired revocations
+func (m DenylistModel) GetActive() (*Denylist, error) {
+	query := `
+        SELECT jti, family, user_id, revoked_at, expiry
+        FROM token_denylist
+        WHERE expiry > NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	denylist := &Denylist{
+		Tokens:   make(map[string]time.Time),
+		Families: make(map[string]time.Time),
+		Users:    make(map[int64]time.Time),
+	}
+
+	for rows.Next() {
+		var (
+			jti       string
+			family    string
+			userId    int64
+			revokedAt time.Time
+			expiry    time.Time
+		)
+
+		err := rows.Scan(&jti, &family, &userId, &revokedAt, &expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		if jti != "" {
+			denylist.Tokens[jti] = expiry
+		}
+
+		if family != "" {
+			denylist.Families[family] = expiry
+		}
+
+		if userId != 0 && revokedAt.After(denylist.Users[userId]) {
+			denylist.Users[userId] = revokedAt
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return denylist, nil
+}
+
+// The DeleteExpired() method deletes the revocations for tokens which have expired anyway. It
+// returns how many were deleted.
+func (m DenylistModel) DeleteExpired() (int64, error) {
+	query := `
+        DELETE FROM token_denylist
+        WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Define the status values an export can have
+const (
+	ExportPending  = "pending"
+	ExportComplete = "complete"
+	ExportFailed   = "failed"
+)
+
+// DataExport holds an archive of a user's personal data. The archive is built in the
+// background, so it is empty until Status is ExportComplete.
+type DataExport struct {
+	ID          int64           `json:"id"`
+	UserID      int64           `json:"-"`
+	Status      string          `json:"status"`
+	Archive     json.RawMessage `json:"archive,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	CompletedAt *time.Time      `json:"completed_at,omitempty"`
+	Expiry      time.Time       `json:"expiry"`
+}
+
+// Define the DataExportModel type.
+type DataExportModel struct {
+	DB *sql.DB
+}
+
+// The New() method creates a pending export for the user, which is kept until ttl has passed
+func (m DataExportModel) New(userId int64, ttl time.Duration) (*DataExport, error) {
+	export := &DataExport{
+		UserID: userId,
+		Status: ExportPending,
+		Expiry: time.Now().Add(ttl),
+	}
+
+	query := `
+        INSERT INTO data_exports (user_id, status, expiry)
+        VALUES ($1, $2, $3)
+        RETURNING id, created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId, export.Status, export.Expiry).Scan(&export.ID, &export.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, nil
+}
+
+// The GetLatestForUser() method returns the newest unexpired export of the user which hasn't
+// failed
+func (m DataExportModel) GetLatestForUser(userId int64) (*DataExport, error) {
+	query := `
+        SELECT id, user_id, status, archive, created_at, completed_at, expiry
+        FROM data_exports
+        WHERE user_id = $1 AND status <> $2 AND expiry > NOW()
+        ORDER BY created_at DESC, id DESC
+        LIMIT 1`
+
+	var (
+		export  DataExport
+		archive []byte
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId, ExportFailed).Scan(
+		&export.ID,
+		&export.UserID,
+		&export.Status,
+		&archive,
+		&export.CreatedAt,
+		&export.CompletedAt,
+		&export.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	export.Archive = archive
+
+	return &export, nil
+}
+
+// The Complete() method stores the finished archive of an export
+func (m DataExportModel) Complete(id int64, archive []byte) error {
+	query := `
+        UPDATE data_exports
+        SET status = $1, archive = $2, completed_at = NOW()
+        WHERE id = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ExportComplete, archive, id)
+	return err
+}
+
+// The Fail() method marks an export as failed, so the user can request a new one
+func (m DataExportModel) Fail(id int64) error {
+	query := `
+        UPDATE data_exports
+        SET status = $1, completed_at = NOW()
+        WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ExportFailed, id)
+	return err
+}
+
+// The DeleteExpired() method deletes the exports which are past their expiry, so personal data
+// isn't kept around longer than needed. It returns how many were deleted.
+func (m DataExportModel) DeleteExpired() (int64, error) {
+	query := `
+        DELETE FROM data_exports
+        WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
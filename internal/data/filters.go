@@ -1,6 +1,10 @@
 package data
 
-import "github.com/mostafejur21/greenlight_go/internal/validator"
+import (
+	"strings"
+
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
 
 type Filters struct {
 	Page         int
@@ -23,3 +27,56 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	//Check that the sort parameter match a value in the safelist
     v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalit sort value")
 }
+
+// sortColumn() returns the column to sort by, once it has been checked against the safelist.
+// The sort value ends up in the SQL query, so this panics rather than let anything else through.
+func (f Filters) sortColumn() string {
+	for _, safeValue := range f.SortSafelist {
+		if f.Sort == safeValue {
+			return strings.TrimPrefix(f.Sort, "-")
+		}
+	}
+
+	panic("unsafe sort parameter: " + f.Sort)
+}
+
+// sortDirection() returns "ASC" or "DESC" depending on the prefix of the sort value
+func (f Filters) sortDirection() string {
+	if strings.HasPrefix(f.Sort, "-") {
+		return "DESC"
+	}
+	return "ASC"
+}
+
+func (f Filters) limit() int {
+	return f.PageSize
+}
+
+func (f Filters) offset() int {
+	return (f.Page - 1) * f.PageSize
+}
+
+// Metadata holds the pagination details which are sent along with a page of records
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records,omitempty"`
+}
+
+// calculateMetadata() works out the pagination metadata from the total number of records.
+// An empty Metadata is returned when there are no records at all.
+func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     (totalRecords + pageSize - 1) / pageSize,
+		TotalRecords: totalRecords,
+	}
+}
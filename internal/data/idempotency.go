@@ -0,0 +1,181 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// IdempotencyKey holds a client supplied Idempotency-Key along with the user who sent it,
+// a hash of the original request and the response that was recorded for it. A nil
+// ResponseStatus means the original request is still being processed, and it holds the key until
+// LockedUntil. Client is the IP address of an anonymous caller, and empty for authenticated ones.
+type IdempotencyKey struct {
+	Key             string
+	UserID          int64
+	Client          string
+	RequestHash     []byte
+	LockedUntil     time.Time
+	ResponseStatus  *int
+	ResponseHeaders http.Header
+	ResponseBody    []byte
+	CreatedAt       time.Time
+	Expiry          time.Time
+}
+
+// Validate the Idempotency-Key header value provided by the client
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(key != "", "idempotency_key", "must be provided")
+	v.Check(len(key) <= 255, "idempotency_key", "must not be more than 255 bytes long")
+}
+
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+// The Reserve() method tries to claim the key for the user. It returns true if the key was
+// free (or the previous record has expired) and false if another request already holds it.
+// A request which never finished, because the server crashed or the response couldn't be
+// stored, only holds the key until its lease runs out, and then a retry of the same request
+// takes it over. The INSERT ... ON CONFLICT is a single statement, so two concurrent requests
+// with the same key can never both reserve it.
+func (m IdempotencyModel) Reserve(key *IdempotencyKey) (bool, error) {
+	query := `
+    INSERT INTO idempotency_keys (key, user_id, client, request_hash, locked_until, expiry)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    ON CONFLICT (key, user_id, client) DO UPDATE
+    SET request_hash = EXCLUDED.request_hash, response_status = NULL, response_headers = NULL,
+        response_body = NULL, created_at = NOW(), locked_until = EXCLUDED.locked_until, expiry = EXCLUDED.expiry
+    WHERE idempotency_keys.expiry < NOW()
+    OR (idempotency_keys.response_status IS NULL AND idempotency_keys.locked_until < NOW()
+        AND idempotency_keys.request_hash = EXCLUDED.request_hash)
+    RETURNING created_at, locked_until`
+
+	args := []any{key.Key, key.UserID, key.Client, key.RequestHash, key.LockedUntil, key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&key.CreatedAt, &key.LockedUntil)
+	if err != nil {
+		switch {
+		// No row returned means the key exists and has not expired yet
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// The Get() method returns the unexpired record for a key, user and client.
+func (m IdempotencyModel) Get(key string, userID int64, client string) (*IdempotencyKey, error) {
+	query := `
+    SELECT key, user_id, client, request_hash, response_status, response_headers, response_body, created_at, expiry
+    FROM idempotency_keys
+    WHERE key = $1 AND user_id = $2 AND client = $3 AND expiry > NOW()`
+
+	var (
+		record  IdempotencyKey
+		status  sql.NullInt64
+		headers []byte
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key, userID, client).Scan(
+		&record.Key,
+		&record.UserID,
+		&record.Client,
+		&record.RequestHash,
+		&status,
+		&headers,
+		&record.ResponseBody,
+		&record.CreatedAt,
+		&record.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if status.Valid {
+		s := int(status.Int64)
+		record.ResponseStatus = &s
+	}
+
+	if headers != nil {
+		err = json.Unmarshal(headers, &record.ResponseHeaders)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &record, nil
+}
+
+// The Complete() method stores the recorded response for a reserved key, so later retries
+// can replay it. Nothing is stored if a retry has taken the key over in the meantime.
+func (m IdempotencyModel) Complete(key *IdempotencyKey) error {
+	headers, err := json.Marshal(key.ResponseHeaders)
+	if err != nil {
+		return err
+	}
+
+	query := `
+    UPDATE idempotency_keys
+    SET response_status = $1, response_headers = $2, response_body = $3, locked_until = NULL
+    WHERE key = $4 AND user_id = $5 AND client = $6 AND locked_until = $7`
+
+	args := []any{key.ResponseStatus, headers, key.ResponseBody, key.Key, key.UserID, key.Client, key.LockedUntil}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// The Delete() method releases a reserved key, for example when the original request failed and
+// the client should be allowed to try again with the same key. A key which a retry has taken
+// over in the meantime is left alone.
+func (m IdempotencyModel) Delete(key *IdempotencyKey) error {
+	query := `
+    DELETE FROM idempotency_keys
+    WHERE key = $1 AND user_id = $2 AND client = $3 AND locked_until = $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key.Key, key.UserID, key.Client, key.LockedUntil)
+	return err
+}
+
+// The DeleteExpired() method deletes the keys which can no longer be replayed. It returns how
+// many were deleted.
+func (m IdempotencyModel) DeleteExpired() (int64, error) {
+	query := `
+    DELETE FROM idempotency_keys
+    WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
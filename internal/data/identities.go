@@ -0,0 +1,198 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Identity links an account at an external OpenID Connect provider, identified by the issuer
+// and subject of its ID tokens, to one of our users.
+type Identity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    int64     `json:"-"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginState is what we need to remember between sending a user to an OpenID Connect provider
+// and them coming back with an authorization code. It is looked up by the state parameter.
+type LoginState struct {
+	State    string
+	Provider string
+	Nonce    string
+	Verifier string
+	Expiry   time.Time
+}
+
+// Define the IdentityModel type.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method links an identity to a user
+func (m IdentityModel) Insert(identity *Identity) error {
+	query := `
+        INSERT INTO user_identities (issuer, subject, user_id, email)
+        VALUES ($1, $2, $3, $4)
+        RETURNING created_at`
+
+	args := []any{identity.Issuer, identity.Subject, identity.UserID, identity.Email}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&identity.CreatedAt)
+}
+
+// The GetUser() method returns the user an identity is linked to
+func (m IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `
+    SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.preferences, users.deletion_scheduled_at, users.disabled_at, users.version
+    FROM users
+    INNER JOIN user_identities
+    ON users.id = user_identities.user_id
+    WHERE user_identities.issuer = $1
+    AND user_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Preferences,
+		&user.DeletionScheduledAt,
+		&user.DisabledAt,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+// The GetAllForUser() method returns every identity linked to the user
+func (m IdentityModel) GetAllForUser(userId int64) ([]*Identity, error) {
+	query := `
+    SELECT issuer, subject, user_id, email, created_at
+    FROM user_identities
+    WHERE user_id = $1
+    ORDER BY created_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	identities := []*Identity{}
+
+	for rows.Next() {
+		var identity Identity
+
+		err := rows.Scan(
+			&identity.Issuer,
+			&identity.Subject,
+			&identity.UserID,
+			&identity.Email,
+			&identity.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, &identity)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// The InsertState() method stores the state of a login which has just been started
+func (m IdentityModel) InsertState(state *LoginState) error {
+	hash := sha256.Sum256([]byte(state.State))
+
+	query := `
+        INSERT INTO oidc_login_states (hash, provider, nonce, verifier, expiry)
+        VALUES ($1, $2, $3, $4, $5)`
+
+	args := []any{hash[:], state.Provider, state.Nonce, state.Verifier, state.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// The ConsumeState() method returns and deletes the unexpired login state for the state
+// parameter, so each state can only be used once
+func (m IdentityModel) ConsumeState(provider, state string) (*LoginState, error) {
+	hash := sha256.Sum256([]byte(state))
+
+	query := `
+        DELETE FROM oidc_login_states
+        WHERE hash = $1 AND provider = $2 AND expiry > $3
+        RETURNING provider, nonce, verifier, expiry`
+
+	loginState := LoginState{State: state}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], provider, time.Now()).Scan(
+		&loginState.Provider,
+		&loginState.Nonce,
+		&loginState.Verifier,
+		&loginState.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &loginState, nil
+}
+
+// The DeleteExpiredStates() method deletes the states of logins which were never finished. It
+// returns how many were deleted.
+func (m IdentityModel) DeleteExpiredStates() (int64, error) {
+	query := `
+        DELETE FROM oidc_login_states
+        WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
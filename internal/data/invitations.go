@@ -0,0 +1,240 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// Invitation lets someone register even when signups are restricted. Permissions are granted
+// to the new account on top of the default ones. Plaintext is only set when the invitation has
+// just been created, we only store the hash.
+type Invitation struct {
+	ID          int64       `json:"id"`
+	Email       string      `json:"email"`
+	Plaintext   string      `json:"-"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	InvitedBy   *int64      `json:"invited_by"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      time.Time   `json:"expiry"`
+	AcceptedAt  *time.Time  `json:"accepted_at"`
+}
+
+func ValidateInvitation(v *validator.Validator, invitation *Invitation) {
+	ValidateEmail(v, invitation.Email)
+
+	v.Check(invitation.Expiry.After(time.Now()), "expiry", "must be in the future")
+	v.Check(validator.Unique(invitation.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// Define the InvitationModel type.
+type InvitationModel struct {
+	DB *sql.DB
+}
+
+// The New() method generates the token of a new invitation and inserts it. The token looks just
+// like the other tokens, so it can be checked with ValidateTokenPlaintext().
+func (m InvitationModel) New(invitation *Invitation) error {
+	token, err := generateToken(0, time.Until(invitation.Expiry), "")
+	if err != nil {
+		return err
+	}
+
+	invitation.Plaintext = token.Plaintext
+	invitation.Hash = token.Hash
+
+	if invitation.Permissions == nil {
+		invitation.Permissions = Permissions{}
+	}
+
+	query := `
+        INSERT INTO invitations (email, hash, permissions, invited_by, expiry)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at`
+
+	args := []any{invitation.Email, invitation.Hash, pq.Array(invitation.Permissions), invitation.InvitedBy, invitation.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// The GetAll() method returns the invitations which haven't been accepted or expired yet,
+// newest first
+func (m InvitationModel) GetAll() ([]*Invitation, error) {
+	query := `
+        SELECT id, email, permissions, invited_by, created_at, expiry, accepted_at
+        FROM invitations
+        WHERE accepted_at IS NULL AND expiry > NOW()
+        ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		var invitation Invitation
+
+		err := rows.Scan(
+			&invitation.ID,
+			&invitation.Email,
+			pq.Array(&invitation.Permissions),
+			&invitation.InvitedBy,
+			&invitation.CreatedAt,
+			&invitation.Expiry,
+			&invitation.AcceptedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invitations = append(invitations, &invitation)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// The GetForToken() method returns the unaccepted, unexpired invitation for a plaintext token
+func (m InvitationModel) GetForToken(tokenPlaintext string) (*Invitation, error) {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT id, email, permissions, invited_by, created_at, expiry, accepted_at
+        FROM invitations
+        WHERE hash = $1 AND accepted_at IS NULL AND expiry > $2`
+
+	var invitation Invitation
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&invitation.ID,
+		&invitation.Email,
+		pq.Array(&invitation.Permissions),
+		&invitation.InvitedBy,
+		&invitation.CreatedAt,
+		&invitation.Expiry,
+		&invitation.AcceptedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+// The Accept() method uses up an invitation to create the user's account, granting them the
+// default permissions and the ones they were invited with. It's all one transaction, so either
+// everything happens or nothing does. It returns ErrEditConflict if the invitation was accepted
+// or expired in the meantime, so each invitation creates at most one account, and
+// ErrDuplicateEmail if the email address already has an account.
+func (m InvitationModel) Accept(invitation *Invitation, user *User, defaults ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        UPDATE invitations
+        SET accepted_at = NOW()
+        WHERE id = $1 AND accepted_at IS NULL AND expiry > NOW()
+        RETURNING accepted_at`
+
+	err = tx.QueryRowContext(ctx, query, invitation.ID).Scan(&invitation.AcceptedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	permissions := append(slices.Clone(defaults), invitation.Permissions...)
+
+	err = addPermissionsForUser(ctx, tx, user.ID, permissions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The Delete() method revokes an invitation which hasn't been accepted yet
+func (m InvitationModel) Delete(id int64) error {
+	query := `
+        DELETE FROM invitations
+        WHERE id = $1 AND accepted_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// The DeleteExpired() method deletes the invitations which expired without being accepted. It
+// returns how many were deleted.
+func (m InvitationModel) DeleteExpired() (int64, error) {
+	query := `
+        DELETE FROM invitations
+        WHERE accepted_at IS NULL AND expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
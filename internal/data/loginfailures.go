@@ -0,0 +1,148 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// LoginFailure counts the consecutive failed logins for a key. Keys are either an email address
+// or a client IP address (see LoginFailureEmailKey() and LoginFailureIPKey()). Failures are
+// counted for email addresses which don't have an account too, so the counts can't be used to
+// find out which addresses are registered.
+type LoginFailure struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+}
+
+func LoginFailureEmailKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func LoginFailureIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// IsIP() reports whether the failures are counted for a client IP address
+func (f LoginFailure) IsIP() bool {
+	return strings.HasPrefix(f.Key, "ip:")
+}
+
+// Define the LoginFailureModel type.
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// The GetAll() method returns the failure counts for the keys. Keys without any recent failures
+// are left out.
+func (m LoginFailureModel) GetAll(keys ...string) ([]*LoginFailure, error) {
+	query := `
+        SELECT key, failures, last_failure
+        FROM login_failures
+        WHERE key = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	failures := []*LoginFailure{}
+
+	for rows.Next() {
+		var failure LoginFailure
+
+		err := rows.Scan(&failure.Key, &failure.Failures, &failure.LastFailure)
+		if err != nil {
+			return nil, err
+		}
+
+		failures = append(failures, &failure)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return failures, nil
+}
+
+// The RecordFailure() method adds a failed login to the count for the key and returns the new
+// count. If the previous failure was longer ago than window, counting starts again from one.
+func (m LoginFailureModel) RecordFailure(key string, window time.Duration) (*LoginFailure, error) {
+	query := `
+        INSERT INTO login_failures (key, failures, last_failure)
+        VALUES ($1, 1, NOW())
+        ON CONFLICT (key) DO UPDATE
+        SET failures = CASE WHEN login_failures.last_failure < NOW() - $2 * INTERVAL '1 second' THEN 1
+            ELSE login_failures.failures + 1 END,
+            last_failure = NOW()
+        RETURNING key, failures, last_failure`
+
+	var failure LoginFailure
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key, window.Seconds()).Scan(&failure.Key, &failure.Failures, &failure.LastFailure)
+	if err != nil {
+		return nil, err
+	}
+
+	return &failure, nil
+}
+
+// The Forgive() method takes one failure back off the count for the key, for an attempt which
+// was counted up front and then succeeded
+func (m LoginFailureModel) Forgive(key string) error {
+	query := `
+        UPDATE login_failures
+        SET failures = failures - 1
+        WHERE key = $1 AND failures > 0`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// The Reset() method clears the failure counts for the keys, after a successful login or when
+// an admin unlocks an account
+func (m LoginFailureModel) Reset(keys ...string) error {
+	query := `
+        DELETE FROM login_failures
+        WHERE key = ANY($1)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(keys))
+	return err
+}
+
+// The DeleteOlderThan() method deletes the failure counts whose last failure was more than age
+// ago. It returns how many were deleted.
+func (m LoginFailureModel) DeleteOlderThan(age time.Duration) (int64, error) {
+	query := `
+        DELETE FROM login_failures
+        WHERE last_failure < NOW() - $1 * INTERVAL '1 second'`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, age.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
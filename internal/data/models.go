@@ -13,18 +13,38 @@ var (
 // The Models struct wraps the MovieModel. we'll add other models to this,
 // like UserModel, PermissionModel ect
 type Models struct {
+	APIKeys     APIKeyModel
+	Denylist    DenylistModel
+	Exports     DataExportModel
+	Idempotency IdempotencyModel
+	Identities  IdentityModel
+	Invitations InvitationModel
+	Logins      LoginFailureModel
 	Movies      MovieModel
+	Passkeys    PasskeyModel
 	Permissions PermissionModel
+	Roles       RoleModel
 	Tokens      TokenModel
+	TOTP        TOTPModel
 	Users       UserModel
 }
 
 // NewModels will initialize the MovieModel
 func NewModels(db *sql.DB) Models {
 	return Models{
+		APIKeys:     APIKeyModel{DB: db},
+		Denylist:    DenylistModel{DB: db},
+		Exports:     DataExportModel{DB: db},
+		Idempotency: IdempotencyModel{DB: db},
+		Identities:  IdentityModel{DB: db},
+		Invitations: InvitationModel{DB: db},
+		Logins:      LoginFailureModel{DB: db},
 		Movies:      MovieModel{DB: db},
+		Passkeys:    PasskeyModel{DB: db},
 		Permissions: PermissionModel{DB: db},
+		Roles:       RoleModel{DB: db},
 		Tokens:      TokenModel{DB: db},
+		TOTP:        TOTPModel{DB: db},
 		Users:       UserModel{DB: db},
 	}
 }
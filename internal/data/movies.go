@@ -21,14 +21,14 @@ type MovieModel struct {
 func (m MovieModel) Insert(movie *Movie) error {
 	// Define a SQL query for inserting a new record in the movies table and returning the system-generated data
 	query := `
-        INSERT INTO movies (title, year, runtime, genres)
-        VALUES ($1, $2, $3, $4)
+        INSERT INTO movies (title, year, runtime, genres, created_by)
+        VALUES ($1, $2, $3, $4, $5)
         RETURNING id, created_at, version`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	// Create an args slice containing the values for the placeholder params from the movies struct.
-	args := []any{movie.Title, movie.Year, movie.RunTime, pq.Array(movie.Genres)}
+	args := []any{movie.Title, movie.Year, movie.RunTime, pq.Array(movie.Genres), movie.CreatedBy}
 
 	// Use the DB.QueryRow() method to execute the SQL query on our connection pool,
 	// passing in the args slice as a variadic parameters and scanning the system-generated id, created_at and version value into the movies struct
@@ -45,7 +45,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// Define the sql query
 	query := `
-        SELECT id, created_at, title, year, runtime, genres, version
+        SELECT id, created_at, title, year, runtime, genres, created_by, version
         FROM movies
         WHERE id = $1`
 	var movie Movie
@@ -68,6 +68,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Year,
 		&movie.RunTime,
 		pq.Array(&movie.Genres),
+		&movie.CreatedBy,
 		&movie.Version,
 	)
 
@@ -90,7 +91,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 // GetAll() method which will returns a slice of movies.
 func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, error) {
 	query := `
-    SELECT id, created_at, title, year, runtime, genres, version
+    SELECT id, created_at, title, year, runtime, genres, created_by, version
     FROM movies
     WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
     AND (genres @> $2 OR $2 = '{}')
@@ -124,6 +125,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Year,
 			&movie.RunTime,
 			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
 			&movie.Version,
 		)
 		if err != nil {
@@ -217,6 +219,7 @@ type Movie struct {
 	Year      int32     `json:"year,omitempty"`     // the omitempty will hide the field only if the value is empty
 	RunTime   Runtime   `json:"run_time,omitempty"` // if we add the string directive, the RunTime field will be shown as a string in the response
 	Genres    []string  `json:"genres,omitempty"`
+	CreatedBy *int64    `json:"created_by,omitempty"` // nil once the creator's account has been deleted
 	Version   int32     `json:"version"`
 }
 
@@ -241,3 +244,49 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	// Note: using the validators Unique() method to check weather the Genres has unique slice or not
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
+
+// The GetAllForCreator() method returns every movie a user has added, oldest first
+func (m MovieModel) GetAllForCreator(userId int64) ([]*Movie, error) {
+	query := `
+    SELECT id, created_at, title, year, runtime, genres, created_by, version
+    FROM movies
+    WHERE created_by = $1
+    ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.RunTime,
+			pq.Array(&movie.Genres),
+			&movie.CreatedBy,
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		movies = append(movies, &movie)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
@@ -0,0 +1,273 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+var ErrDuplicateCredential = errors.New("duplicate credential")
+
+// Passkey is a WebAuthn credential a user can log in with. We only keep the public key, the
+// private key never leaves the user's authenticator.
+type Passkey struct {
+	ID           int64      `json:"id"`
+	UserID       int64      `json:"-"`
+	Name         string     `json:"name"`
+	CredentialID []byte     `json:"credential_id"`
+	PublicKey    []byte     `json:"-"`
+	SignCount    uint32     `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+func ValidatePasskey(v *validator.Validator, passkey *Passkey) {
+	v.Check(passkey.Name != "", "name", "must be provided")
+	v.Check(len(passkey.Name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+// Define the PasskeyModel type.
+type PasskeyModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method stores a newly registered passkey
+func (m PasskeyModel) Insert(passkey *Passkey) error {
+	query := `
+        INSERT INTO passkeys (user_id, name, credential_id, public_key, sign_count)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at`
+
+	args := []any{passkey.UserID, passkey.Name, passkey.CredentialID, passkey.PublicKey, int64(passkey.SignCount)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&passkey.ID, &passkey.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "passkeys_credential_id_key"`:
+			return ErrDuplicateCredential
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The GetAllForUser() method returns every passkey of the user, oldest first
+func (m PasskeyModel) GetAllForUser(userId int64) ([]*Passkey, error) {
+	query := `
+        SELECT id, user_id, name, credential_id, public_key, sign_count, created_at, last_used_at
+        FROM passkeys
+        WHERE user_id = $1
+        ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+
+	for rows.Next() {
+		var passkey Passkey
+
+		err := rows.Scan(
+			&passkey.ID,
+			&passkey.UserID,
+			&passkey.Name,
+			&passkey.CredentialID,
+			&passkey.PublicKey,
+			&passkey.SignCount,
+			&passkey.CreatedAt,
+			&passkey.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		passkeys = append(passkeys, &passkey)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return passkeys, nil
+}
+
+// The GetForCredentialID() method returns the passkey with the WebAuthn credential id
+func (m PasskeyModel) GetForCredentialID(credentialID []byte) (*Passkey, error) {
+	query := `
+        SELECT id, user_id, name, credential_id, public_key, sign_count, created_at, last_used_at
+        FROM passkeys
+        WHERE credential_id = $1`
+
+	var passkey Passkey
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, credentialID).Scan(
+		&passkey.ID,
+		&passkey.UserID,
+		&passkey.Name,
+		&passkey.CredentialID,
+		&passkey.PublicKey,
+		&passkey.SignCount,
+		&passkey.CreatedAt,
+		&passkey.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &passkey, nil
+}
+
+// The Use() method records a login with the passkey and its new signature counter. The counter
+// is only ever allowed to go up (authenticators which don't count always send 0), so it returns
+// ErrEditConflict if another login with a higher counter got there first.
+func (m PasskeyModel) Use(passkey *Passkey, signCount uint32) error {
+	query := `
+        UPDATE passkeys
+        SET sign_count = $1, last_used_at = NOW()
+        WHERE id = $2 AND (sign_count < $1 OR $1 = 0)
+        RETURNING last_used_at`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, int64(signCount), passkey.ID).Scan(&passkey.LastUsedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	passkey.SignCount = signCount
+
+	return nil
+}
+
+// The DeleteForUser() method deletes one of the user's passkeys
+func (m PasskeyModel) DeleteForUser(id, userId int64) error {
+	query := `
+        DELETE FROM passkeys
+        WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// The NewChallenge() method starts a registration (for the user) or a login (with a nil user)
+// and returns its random challenge. The challenge is base64url encoded, which is exactly how
+// the browser repeats it back in the client data.
+func (m PasskeyModel) NewChallenge(userId *int64, ttl time.Duration) (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := base64.RawURLEncoding.EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(challenge))
+
+	query := `
+        INSERT INTO passkey_challenges (hash, user_id, expiry)
+        VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, hash[:], userId, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+// The ConsumeChallenge() method deletes an unexpired challenge, so each one can only be used
+// once, and returns the user it was issued to (nil for logins)
+func (m PasskeyModel) ConsumeChallenge(challenge string) (*int64, error) {
+	hash := sha256.Sum256([]byte(challenge))
+
+	query := `
+        DELETE FROM passkey_challenges
+        WHERE hash = $1 AND expiry > $2
+        RETURNING user_id`
+
+	var userId *int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(&userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return userId, nil
+}
+
+// The DeleteExpiredChallenges() method deletes the challenges of ceremonies which were never
+// finished. It returns how many were deleted.
+func (m PasskeyModel) DeleteExpiredChallenges() (int64, error) {
+	query := `
+        DELETE FROM passkey_challenges
+        WHERE expiry < NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
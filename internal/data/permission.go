@@ -3,6 +3,7 @@ package data
 import (
 	"context"
 	"database/sql"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -11,41 +12,81 @@ import (
 // Permission slice like ("movie:read" and "movie:write")
 type Permissions []string
 
-// check if the Permissions slice contain a specific permission code
+// check if the Permissions slice contain a specific permission code, either exactly or through
+// a wildcard code like "movies:*" or "*:read"
 func (p Permissions) Include(code string) bool {
 	for i := range p {
-		if code == p[i] {
+		if matchPermission(p[i], code) {
 			return true
 		}
 	}
 	return false
 }
 
+// matchPermission() reports whether a granted permission code covers the required one. Each
+// colon separated part of the granted code has to be equal to the required part, or "*".
+func matchPermission(granted, code string) bool {
+	if granted == code {
+		return true
+	}
+
+	grantedParts := strings.Split(granted, ":")
+	codeParts := strings.Split(code, ":")
+
+	if len(grantedParts) != len(codeParts) {
+		return false
+	}
+
+	for i := range grantedParts {
+		if grantedParts[i] != "*" && grantedParts[i] != codeParts[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
 type PermissionModel struct {
 	DB *sql.DB
 }
 
 // Add the provided permission codes for a specific user.
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
-	query := `
-    INSERT INTO users_permissions
-    SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	return addPermissionsForUser(ctx, m.DB, userID, codes)
+}
 
+// execer is satisfied by both *sql.DB and *sql.Tx, like queryRower
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func addPermissionsForUser(ctx context.Context, e execer, userID int64, codes []string) error {
+	query := `
+    INSERT INTO users_permissions
+    SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+    ON CONFLICT DO NOTHING`
+
+	_, err := e.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
 }
 
 // The GetAllForUser() method will return all permission codes for a specific user in a Permissions slice.
+// These are the user's effective permissions, granted to them directly or through their roles.
 func (m PermissionModel) GetAllForUser(userId int64) (Permissions, error) {
 	query := `
     SELECT permissions.code
     FROM permissions
-    INNER JOIN users_permissions ON user_permissions.permission_id = permission.id
-    INNER JOIN users ON users_permissions.user_id = users.id
-    WHERE users.id = $1`
+    INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+    WHERE users_permissions.user_id = $1
+    UNION
+    SELECT permissions.code
+    FROM permissions
+    INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+    INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+    WHERE users_roles.user_id = $1`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -73,3 +114,51 @@ func (m PermissionModel) GetAllForUser(userId int64) (Permissions, error) {
 
 	return permissions, nil
 }
+
+// The RemoveForUser() method removes the provided permission codes from a specific user.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+    DELETE FROM users_permissions
+    WHERE user_id = $1
+    AND permission_id IN (SELECT permissions.id FROM permissions WHERE permissions.code = ANY($2))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// The GetAll() method returns every permission code that exists.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	query := `
+    SELECT code
+    FROM permissions
+    ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	permissions := Permissions{}
+	for rows.Next() {
+		var permission string
+		err := rows.Scan(&permission)
+
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
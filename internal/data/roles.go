@@ -0,0 +1,328 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+var (
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+
+	RoleNameRX = regexp.MustCompile("^[a-z0-9_-]+$")
+)
+
+// Role is a named bundle of permissions. Users who are given a role get all of its permissions
+// on top of the ones granted to them directly.
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Version     int         `json:"version"`
+}
+
+// ValidateRole() checks a role, where known holds every permission code which exists
+func ValidateRole(v *validator.Validator, role *Role, known Permissions) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(role.Name, RoleNameRX), "name", "must only contain lowercase letters, digits, dashes and underscores")
+
+	v.Check(len(role.Description) <= 500, "description", "must not be more than 500 bytes long")
+
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+	for _, code := range role.Permissions {
+		v.Check(slices.Contains(known, code), "permissions", "must only contain existing permission codes")
+	}
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method creates a role along with its permissions
+func (m RoleModel) Insert(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        INSERT INTO roles (name, description)
+        VALUES ($1, $2)
+        RETURNING id, created_at, version`
+
+	err = tx.QueryRowContext(ctx, query, role.Name, role.Description).Scan(&role.ID, &role.CreatedAt, &role.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setRolePermissions() replaces the permissions of a role with role.Permissions
+func setRolePermissions(ctx context.Context, tx *sql.Tx, role *Role) error {
+	query := `
+        DELETE FROM roles_permissions
+        WHERE role_id = $1`
+
+	_, err := tx.ExecContext(ctx, query, role.ID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+        INSERT INTO roles_permissions
+        SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	_, err = tx.ExecContext(ctx, query, role.ID, pq.Array(role.Permissions))
+	return err
+}
+
+// The Get() method returns a role with its permissions
+func (m RoleModel) Get(id int64) (*Role, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+        SELECT roles.id, roles.name, roles.description, roles.created_at, roles.version,
+            COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+        FROM roles
+        LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+        LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+        WHERE roles.id = $1
+        GROUP BY roles.id`
+
+	var role Role
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&role.ID,
+		&role.Name,
+		&role.Description,
+		&role.CreatedAt,
+		&role.Version,
+		pq.Array(&role.Permissions),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &role, nil
+}
+
+// The GetAll() method returns every role with its permissions, sorted by name
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+        SELECT roles.id, roles.name, roles.description, roles.created_at, roles.version,
+            COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+        FROM roles
+        LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+        LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+        GROUP BY roles.id
+        ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(
+			&role.ID,
+			&role.Name,
+			&role.Description,
+			&role.CreatedAt,
+			&role.Version,
+			pq.Array(&role.Permissions),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// The Update() method saves a role and replaces its permissions, as long as the role hasn't
+// been changed since it was read
+func (m RoleModel) Update(role *Role) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        UPDATE roles
+        SET name = $1, description = $2, version = version + 1
+        WHERE id = $3 AND version = $4
+        RETURNING version`
+
+	args := []any{role.Name, role.Description, role.ID, role.Version}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&role.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	err = setRolePermissions(ctx, tx, role)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The Delete() method deletes a role, which takes it away from every user who had it
+func (m RoleModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+        DELETE FROM roles
+        WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// The AddForUser() method gives the roles with the provided names to a user
+func (m RoleModel) AddForUser(userID int64, names ...string) error {
+	query := `
+        INSERT INTO users_roles
+        SELECT $1, roles.id FROM roles WHERE roles.name = ANY($2)
+        ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	return err
+}
+
+// The RemoveForUser() method takes the roles with the provided names away from a user
+func (m RoleModel) RemoveForUser(userID int64, names ...string) error {
+	query := `
+        DELETE FROM users_roles
+        WHERE user_id = $1
+        AND role_id IN (SELECT roles.id FROM roles WHERE roles.name = ANY($2))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	return err
+}
+
+// The GetNamesForUser() method returns the names of the roles a user has
+func (m RoleModel) GetNamesForUser(userID int64) ([]string, error) {
+	query := `
+        SELECT roles.name
+        FROM roles
+        INNER JOIN users_roles ON users_roles.role_id = roles.id
+        WHERE users_roles.user_id = $1
+        ORDER BY roles.name`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/mostafejur21/greenlight_go/internal/validator"
@@ -14,14 +15,42 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeTOTPChallenge  = "totp-challenge"
+	ScopeEmailChange    = "email-change"
+	ScopeMagicLink      = "magic-link"
 )
 
+// ErrTokenReused is returned when a refresh token which has already been rotated is presented
+// again. This should never happen for a well-behaved client, so we treat it as a sign that the
+// token was stolen.
+var ErrTokenReused = errors.New("token reused")
+
 type Token struct {
+	ID        int64     `json:"-"`
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserId    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	CreatedAt time.Time `json:"-"`
+	IP        string    `json:"-"`
+	UserAgent string    `json:"-"`
+	Family    string    `json:"-"`
+}
+
+// Session is the client facing view of a token family (one login and all of the tokens it
+// has been refreshed into), used for listing the places a user is logged in from. It never
+// includes the tokens themselves.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	Current    bool       `json:"current"`
 }
 
 func generateToken(userId int64, ttl time.Duration, scope string) (*Token, error) {
@@ -62,6 +91,18 @@ func generateToken(userId int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
+// generateFamily() returns a random identifier for a new token family
+func generateFamily() (string, error) {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
 // Validate plaintext token provided by the user
 func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
@@ -87,18 +128,172 @@ func (m TokenModel) New(userId int64, ttl time.Duration, scope string) (*Token,
 	return token, err
 }
 
-// Insert() method adds the data for a specific token to the tokens table
-func (m TokenModel) Insert(token *Token) error {
+// The NewSession() method creates a short-lived authentication token and a long-lived refresh
+// token for a user. Both tokens belong to a new token family, which is how we find every
+// token descended from one login when a refresh token is rotated or revoked. The IP address
+// and user agent are recorded so the session can be shown in the user's list of sessions.
+// Passing a zero accessTTL skips the authentication token, the returned one is then nil.
+func (m TokenModel) NewSession(userId int64, accessTTL, refreshTTL time.Duration, ip, userAgent string) (*Token, *Token, error) {
+	family, err := generateFamily()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	access, refresh, err := insertSessionTokens(ctx, tx, userId, accessTTL, refreshTTL, family, ip, userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// The Rotate() method exchanges a refresh token for a new authentication token and a new
+// refresh token in the same family. The old refresh token is kept but marked as rotated, so
+// if it is ever presented again we know it has been copied and revoke the whole family. As
+// with NewSession(), a zero accessTTL skips the authentication token. The refresh tokens of
+// disabled accounts are treated as if they don't exist.
+func (m TokenModel) Rotate(refreshPlaintext string, accessTTL, refreshTTL time.Duration, ip, userAgent string) (*Token, *Token, error) {
+	refreshHash := sha256.Sum256([]byte(refreshPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the row, so two concurrent refreshes with the same token are handled one by one
 	query := `
-        INSERT INTO tokens (hash, user_id, expiry, scope)
-        VALUES ($1, $2, $3, $4)`
-	args := []any{token.Hash, token.UserId, token.Expiry, token.Scope}
+        SELECT tokens.user_id, tokens.family, tokens.rotated_at IS NOT NULL
+        FROM tokens
+        INNER JOIN users ON users.id = tokens.user_id
+        WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3 AND users.disabled_at IS NULL
+        FOR UPDATE OF tokens`
+
+	var (
+		userId  int64
+		family  string
+		rotated bool
+	)
+
+	err = tx.QueryRowContext(ctx, query, refreshHash[:], ScopeRefresh, time.Now()).Scan(&userId, &family, &rotated)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if rotated {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET rotated_at = NOW() WHERE hash = $1`, refreshHash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The authentication tokens issued earlier in the family are replaced by the new one
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1 AND scope = $2`, family, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	access, refresh, err := insertSessionTokens(ctx, tx, userId, accessTTL, refreshTTL, family, ip, userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// insertSessionTokens() generates an authentication and refresh token pair for the family and
+// inserts them as part of the given transaction. If accessTTL is zero only the refresh token is
+// created, for when the caller issues a signed authentication token instead.
+func insertSessionTokens(ctx context.Context, tx *sql.Tx, userId int64, accessTTL, refreshTTL time.Duration, family, ip, userAgent string) (*Token, *Token, error) {
+	refresh, err := generateToken(userId, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens := []*Token{refresh}
 
+	var access *Token
+	if accessTTL > 0 {
+		access, err = generateToken(userId, accessTTL, ScopeAuthentication)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		tokens = append(tokens, access)
+	}
+
+	for _, token := range tokens {
+		token.Family = family
+		token.IP = ip
+		token.UserAgent = userAgent
+
+		err = insertToken(ctx, tx, token)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return access, refresh, nil
+}
+
+// Insert() method adds the data for a specific token to the tokens table
+func (m TokenModel) Insert(token *Token) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	return insertToken(ctx, m.DB, token)
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx, so the same insert can be used on its
+// own or as part of a transaction
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func insertToken(ctx context.Context, q queryRower, token *Token) error {
+	query := `
+        INSERT INTO tokens (hash, user_id, expiry, scope, ip, user_agent, family)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id, created_at`
+	args := []any{token.Hash, token.UserId, token.Expiry, token.Scope, token.IP, token.UserAgent, token.Family}
+
+	return q.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
 }
 
 // Delete() token
@@ -112,3 +307,259 @@ func (m TokenModel) DeleteAllForUser(scope string, userId int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userId)
 	return err
 }
+
+// DeleteAllSessionsForUser() revokes every authentication and refresh token of a user, which
+// logs them out everywhere. Unused magic link tokens go too, as they can start a new session.
+func (m TokenModel) DeleteAllSessionsForUser(userId int64) error {
+	query := `
+        DELETE FROM tokens
+        WHERE scope IN ($1, $2, $3) AND user_id = $4`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ScopeAuthentication, ScopeRefresh, ScopeMagicLink, userId)
+	return err
+}
+
+// DeleteForPlaintext() deletes a token along with the rest of its token family (so the
+// refresh token of a session goes too), used when a client logs out
+func (m TokenModel) DeleteForPlaintext(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        DELETE FROM tokens
+        WHERE (scope = $1 AND hash = $2)
+        OR family IN (SELECT family FROM tokens WHERE scope = $1 AND hash = $2 AND family <> '')`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// GetForPlaintext() returns an unexpired token of the given scope, without its plaintext
+func (m TokenModel) GetForPlaintext(scope, tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        SELECT id, user_id, expiry, scope, created_at, family
+        FROM tokens
+        WHERE hash = $1 AND scope = $2 AND expiry > $3`
+
+	token := Token{Hash: tokenHash[:]}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(
+		&token.ID,
+		&token.UserId,
+		&token.Expiry,
+		&token.Scope,
+		&token.CreatedAt,
+		&token.Family,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// Consume() deletes an unexpired token and returns the id of the user it belonged to. Deleting
+// and checking the token in one statement means it can only ever be used once, even when it is
+// presented twice at the same time.
+func (m TokenModel) Consume(scope, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        DELETE FROM tokens
+        WHERE hash = $1 AND scope = $2 AND expiry > $3
+        RETURNING user_id`
+
+	var userId int64
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(&userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	return userId, nil
+}
+
+// DeleteForUser() deletes a single token by its id, along with the rest of its token family,
+// and returns the family so any signed tokens issued to it can be revoked too. The user id is
+// part of the WHERE clause so that users can only ever delete their own tokens.
+func (m TokenModel) DeleteForUser(scope string, id, userId int64) (string, error) {
+	query := `
+        DELETE FROM tokens
+        WHERE user_id = $3
+        AND ((scope = $1 AND id = $2)
+        OR family IN (SELECT family FROM tokens WHERE scope = $1 AND id = $2 AND user_id = $3 AND family <> ''))
+        RETURNING family`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, scope, id, userId)
+	if err != nil {
+		return "", err
+	}
+
+	defer rows.Close()
+
+	var (
+		family string
+		found  bool
+	)
+
+	// every deleted token belongs to the same family
+	for rows.Next() {
+		err := rows.Scan(&family)
+		if err != nil {
+			return "", err
+		}
+		found = true
+	}
+
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	if !found {
+		return "", ErrRecordNotFound
+	}
+
+	return family, nil
+}
+
+// Touch() records that a token has just been used. To avoid a write on every single request
+// the timestamp is only moved forward once a minute.
+func (m TokenModel) Touch(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+        UPDATE tokens
+        SET last_used_at = NOW()
+        WHERE scope = $1 AND hash = $2
+        AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// GetSessionsForUser() returns the active sessions of a user, newest first. A session is
+// identified by the current (not yet rotated) refresh token of a token family, and the
+// session which currentPlaintext (the token used for this request) belongs to is marked as
+// the current one.
+func (m TokenModel) GetSessionsForUser(userId int64, currentPlaintext string) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+
+	query := `
+        SELECT head.id, MIN(t.created_at), MAX(t.last_used_at), head.expiry, head.ip, head.user_agent, bool_or(t.hash = $3)
+        FROM tokens head
+        INNER JOIN tokens t ON t.family = head.family
+        WHERE head.user_id = $1 AND head.scope = $2 AND head.rotated_at IS NULL AND head.expiry > NOW()
+        GROUP BY head.id, head.expiry, head.ip, head.user_agent
+        ORDER BY MIN(t.created_at) DESC, head.id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userId, ScopeRefresh, currentHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.IP,
+			&session.UserAgent,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// DeleteFamily() deletes every token in a token family of the user
+func (m TokenModel) DeleteFamily(family string, userId int64) error {
+	query := `
+        DELETE FROM tokens
+        WHERE family = $1 AND user_id = $2 AND family <> ''`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, family, userId)
+	return err
+}
+
+// DeleteOtherSessionsForUser() deletes every session of the user except the one the given
+// token belongs to. The session is identified by family, which is taken from the token itself
+// when it is an opaque token, or can be passed in for signed tokens which aren't stored.
+func (m TokenModel) DeleteOtherSessionsForUser(userId int64, currentPlaintext, family string) error {
+	tokenHash := sha256.Sum256([]byte(currentPlaintext))
+
+	query := `
+        DELETE FROM tokens
+        WHERE scope IN ($1, $2) AND user_id = $3 AND hash <> $4
+        AND (family = '' OR family <> COALESCE(
+            NULLIF($5, ''),
+            (SELECT family FROM tokens WHERE hash = $4 AND user_id = $3),
+            ''))`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ScopeAuthentication, ScopeRefresh, userId, tokenHash[:], family)
+	return err
+}
+
+// DeleteExpired() deletes up to limit expired tokens and returns how many were deleted. Keeping
+// each batch small means the table isn't locked for long, and the caller can stop in between.
+func (m TokenModel) DeleteExpired(limit int) (int64, error) {
+	query := `
+        DELETE FROM tokens
+        WHERE id IN (SELECT id FROM tokens WHERE expiry < NOW() LIMIT $1)`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,281 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mostafejur21/greenlight_go/internal/validator"
+)
+
+// How many recovery codes a user gets when they enable two-factor authentication
+const recoveryCodeCount = 10
+
+// TOTP holds the two-factor authentication secret of a user. It only protects logins once it
+// has been confirmed with a first code. LastStep is the time step of the last accepted code.
+type TOTP struct {
+	UserID    int64
+	Secret    string
+	Confirmed bool
+	LastStep  int64
+	CreatedAt time.Time
+}
+
+// Validate the TOTP code provided by the user
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+// Validate a recovery code provided by the user
+func ValidateRecoveryCode(v *validator.Validator, code string) {
+	v.Check(code != "", "recovery_code", "must be provided")
+	v.Check(len(normalizeRecoveryCode(code)) == 10, "recovery_code", "must be a valid recovery code")
+}
+
+// generateRecoveryCodes() returns a set of new recovery codes (formatted like "abcde-fghij") and
+// their hashes
+func generateRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 8)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+
+		hash := sha256.Sum256([]byte(code))
+		hashes[i] = hash[:]
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode() strips the dash and whitespace, so "ABCDE-FGHIJ" and "abcdefghij" match
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// Define the TOTPModel type.
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// The Get() method returns the TOTP record of the user
+func (m TOTPModel) Get(userId int64) (*TOTP, error) {
+	query := `
+        SELECT user_id, secret, confirmed, last_step, created_at
+        FROM totp
+        WHERE user_id = $1`
+
+	var totp TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userId).Scan(
+		&totp.UserID,
+		&totp.Secret,
+		&totp.Confirmed,
+		&totp.LastStep,
+		&totp.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &totp, nil
+}
+
+// The IsEnabled() method reports whether the user has confirmed two-factor authentication
+func (m TOTPModel) IsEnabled(userId int64) (bool, error) {
+	totp, err := m.Get(userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return totp.Confirmed, nil
+}
+
+// The SetPending() method stores a new, unconfirmed secret for the user, replacing any earlier
+// unconfirmed one. A confirmed secret is never replaced, ErrEditConflict is returned instead.
+func (m TOTPModel) SetPending(userId int64, secret string) error {
+	query := `
+        INSERT INTO totp (user_id, secret)
+        VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE
+        SET secret = EXCLUDED.secret, last_step = 0, created_at = NOW()
+        WHERE totp.confirmed = false`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// The Confirm() method enables two-factor authentication for the user after they have entered
+// the code for step, and returns a fresh set of recovery codes. Only the hashes of the recovery
+// codes are stored.
+func (m TOTPModel) Confirm(userId int64, step int64) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+        UPDATE totp
+        SET confirmed = true, last_step = $2
+        WHERE user_id = $1 AND confirmed = false`
+
+	result, err := tx.ExecContext(ctx, query, userId, step)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if rowsAffected == 0 {
+		return nil, ErrEditConflict
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hash := range hashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (hash, user_id) VALUES ($1, $2)`, hash, userId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// The UseStep() method records that the code for step has been used. It returns false if that
+// code (or a later one) has already been used, which stops a code from being replayed.
+func (m TOTPModel) UseStep(userId int64, step int64) (bool, error) {
+	query := `
+        UPDATE totp
+        SET last_step = $2
+        WHERE user_id = $1 AND confirmed = true AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// The UseRecoveryCode() method marks one of the user's recovery codes as used. It returns false
+// if the code doesn't exist or has been used before.
+func (m TOTPModel) UseRecoveryCode(userId int64, code string) (bool, error) {
+	hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+
+	query := `
+        UPDATE totp_recovery_codes
+        SET used_at = NOW()
+        WHERE hash = $1 AND user_id = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hash[:], userId)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// The Delete() method disables two-factor authentication for the user
+func (m TOTPModel) Delete(userId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp WHERE user_id = $1`, userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
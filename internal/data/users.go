@@ -4,11 +4,15 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/mostafejur21/greenlight_go/internal/passhash"
 	"github.com/mostafejur21/greenlight_go/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -24,31 +28,75 @@ type UserModel struct {
 }
 
 type User struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	ID                  int64       `json:"id"`
+	CreatedAt           time.Time   `json:"created_at"`
+	Name                string      `json:"name"`
+	Email               string      `json:"email"`
+	Password            password    `json:"-"`
+	Activated           bool        `json:"activated"`
+	Preferences         Preferences `json:"preferences"`
+	DeletionScheduledAt *time.Time  `json:"deletion_scheduled_at,omitempty"`
+	DisabledAt          *time.Time  `json:"disabled_at,omitempty"`
+	Version             int         `json:"-"`
+}
+
+// Preferences holds free-form settings the user can store for their clients, like their
+// preferred language. It is stored as a jsonb column.
+type Preferences map[string]any
+
+// Value() implements the driver.Valuer interface, so Preferences can be used as a query argument
+func (p Preferences) Value() (driver.Value, error) {
+	if p == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(p)
+}
+
+// Scan() implements the sql.Scanner interface, so a jsonb column can be scanned into Preferences
+func (p *Preferences) Scan(src any) error {
+	var b []byte
+
+	switch v := src.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	case nil:
+		*p = Preferences{}
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Preferences", src)
+	}
+
+	return json.Unmarshal(b, p)
 }
 
 func (u *User) IsAnonymous() bool {
     return u == AnonymousUser
 }
 
+// IsDisabled() reports whether an admin has disabled the account. Unlike an account which was
+// never activated, a disabled account can't be used at all until an admin enables it again.
+func (u *User) IsDisabled() bool {
+	return u.DisabledAt != nil
+}
+
 func (m UserModel) Insert(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertUser(ctx, m.DB, user)
+}
+
+func insertUser(ctx context.Context, q queryRower, user *User) error {
 	query := `
-    INSERT INTO users (name, email, password_hash, activated)
-    VALUES ($1, $2, $3, $4)
+    INSERT INTO users (name, email, password_hash, activated, preferences)
+    VALUES ($1, $2, $3, $4, $5)
     RETURNING id, created_at, version`
 
-	args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+	args := []any{user.Name, user.Email, user.Password.hash, user.Activated, user.Preferences}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := q.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 
 	if err != nil {
 		switch {
@@ -61,9 +109,44 @@ func (m UserModel) Insert(user *User) error {
 	return nil
 }
 
+func (m UserModel) Get(id int64) (*User, error) {
+	query := `
+    SELECT id, created_at, name, email, password_hash, activated, preferences, deletion_scheduled_at, disabled_at, version
+    FROM users
+    WHERE id = $1`
+
+	var user User
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Preferences,
+		&user.DeletionScheduledAt,
+		&user.DisabledAt,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-    SELECT id, created_at, name, email, password_hash, activated, version
+    SELECT id, created_at, name, email, password_hash, activated, preferences, deletion_scheduled_at, disabled_at, version
     FROM users
     WHERE email = $1`
 
@@ -78,6 +161,9 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Preferences,
+		&user.DeletionScheduledAt,
+		&user.DisabledAt,
 		&user.Version,
 	)
 
@@ -93,11 +179,93 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// The GetAll() method returns a page of users matching the filters, for the admin API. search
+// matches part of the name or email address, and the optional activated, disabled, createdAfter,
+// createdBefore and permission filters are ignored when nil or empty. The permission filter
+// matches the users' effective permissions, granted directly or through a role, and wildcard
+// codes the same way Permissions.Include() does.
+func (m UserModel) GetAll(search string, activated, disabled *bool, createdAfter, createdBefore *time.Time, permission string, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+    SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, preferences, deletion_scheduled_at, disabled_at, version
+    FROM users
+    WHERE (strpos(LOWER(name), LOWER($1)) > 0 OR strpos(LOWER(email), LOWER($1)) > 0 OR $1 = '')
+    AND ($2::boolean IS NULL OR activated = $2)
+    AND ($3::boolean IS NULL OR (disabled_at IS NOT NULL) = $3)
+    AND ($4::timestamptz IS NULL OR created_at >= $4)
+    AND ($5::timestamptz IS NULL OR created_at < $5)
+    AND ($6 = '' OR id IN (
+        SELECT grants.user_id
+        FROM (
+            SELECT users_permissions.user_id, permissions.code
+            FROM users_permissions
+            INNER JOIN permissions ON users_permissions.permission_id = permissions.id
+            UNION
+            SELECT users_roles.user_id, permissions.code
+            FROM users_roles
+            INNER JOIN roles_permissions ON roles_permissions.role_id = users_roles.role_id
+            INNER JOIN permissions ON roles_permissions.permission_id = permissions.id
+        ) AS grants
+        WHERE grants.code = $6
+        OR (cardinality(string_to_array(grants.code, ':')) = cardinality(string_to_array($6, ':'))
+            AND NOT EXISTS (
+                SELECT 1
+                FROM unnest(string_to_array(grants.code, ':'), string_to_array($6, ':')) AS parts(granted, required)
+                WHERE parts.granted <> '*' AND parts.granted <> parts.required))))
+    ORDER BY %s %s, id ASC
+    LIMIT $7 OFFSET $8`, filters.sortColumn(), filters.sortDirection())
+
+	args := []any{search, activated, disabled, createdAfter, createdBefore, permission, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Preferences,
+			&user.DeletionScheduledAt,
+			&user.DisabledAt,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
 func (m UserModel) Update(user *User) error {
 	query := `
     UPDATE users
-    SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-    WHERE id = $5 AND version = $6
+    SET name = $1, email = $2, password_hash = $3, activated = $4, preferences = $5, disabled_at = $6, version = version + 1
+    WHERE id = $7 AND version = $8
     RETURNING version`
 
 	args := []any{
@@ -105,6 +273,8 @@ func (m UserModel) Update(user *User) error {
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Preferences,
+		user.DisabledAt,
 		user.ID,
 		user.Version,
 	}
@@ -113,6 +283,48 @@ func (m UserModel) Update(user *User) error {
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		// no row means the version has changed since the user was read
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// The SetPendingEmail() method stores the address a user wants to change their email to. It
+// only replaces users.email once ConfirmEmailChange() is called.
+func (m UserModel) SetPendingEmail(userId int64, email string) error {
+	query := `
+    UPDATE users
+    SET pending_email = $1
+    WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, email, userId)
+	return err
+}
+
+// The ConfirmEmailChange() method swaps the user's email for their pending email. It returns
+// ErrRecordNotFound if there is no pending email, and ErrDuplicateEmail if somebody else has
+// taken the address in the meantime.
+func (m UserModel) ConfirmEmailChange(userId int64) error {
+	query := `
+    UPDATE users
+    SET email = pending_email, pending_email = NULL, version = version + 1
+    WHERE id = $1 AND pending_email IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -121,19 +333,213 @@ func (m UserModel) Update(user *User) error {
 			return err
 		}
 	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ScheduleDeletion() marks the user's account to be deleted at the given time. Until then the
+// user can still log in and cancel the deletion.
+func (m UserModel) ScheduleDeletion(userId int64, at time.Time) error {
+	query := `
+    UPDATE users
+    SET deletion_scheduled_at = $1
+    WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, at, userId)
+	return err
+}
+
+// CancelDeletion() cancels a scheduled deletion of the user's account
+func (m UserModel) CancelDeletion(userId int64) error {
+	query := `
+    UPDATE users
+    SET deletion_scheduled_at = NULL
+    WHERE id = $1 AND deletion_scheduled_at IS NOT NULL`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
 	return nil
 }
 
+// PurgeDeleted() permanently deletes the accounts whose grace period has run out, and returns
+// how many were deleted. Tokens, permissions, API keys, two-factor settings, linked identities
+// and exports are removed by their ON DELETE CASCADE foreign keys. Idempotency records and
+// failed logins aren't tied to the users table, so they are deleted here as well. Movies the
+// user added are kept, but no longer have an owner.
+func (m UserModel) PurgeDeleted() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+    DELETE FROM idempotency_keys
+    WHERE user_id IN (SELECT id FROM users WHERE deletion_scheduled_at <= NOW())`
+
+	_, err = tx.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	query = `
+    DELETE FROM login_failures
+    WHERE key IN (SELECT 'email:' || LOWER(email) FROM users WHERE deletion_scheduled_at <= NOW())`
+
+	_, err = tx.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	query = `
+    DELETE FROM users
+    WHERE deletion_scheduled_at <= NOW()`
+
+	result, err := tx.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, tx.Commit()
+}
+
+// The GetUnactivatedForReminder() method returns up to limit users who registered before the
+// given time, haven't activated their account and haven't been reminded to yet. Disabled
+// accounts are left alone, they are up to the admins.
+func (m UserModel) GetUnactivatedForReminder(createdBefore time.Time, limit int) ([]*User, error) {
+	query := `
+    SELECT id, created_at, name, email, password_hash, activated, preferences, deletion_scheduled_at, disabled_at, version
+    FROM users
+    WHERE activated = false AND disabled_at IS NULL AND activation_reminder_sent_at IS NULL AND created_at < $1
+    ORDER BY created_at
+    LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, createdBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Preferences,
+			&user.DeletionScheduledAt,
+			&user.DisabledAt,
+			&user.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// The MarkActivationReminderSent() method records that a user has been reminded to activate
+// their account
+func (m UserModel) MarkActivationReminderSent(userId int64) error {
+	query := `
+    UPDATE users
+    SET activation_reminder_sent_at = NOW()
+    WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userId)
+	return err
+}
+
+// The DeleteUnactivated() method deletes users who registered before createdBefore, were
+// reminded to activate their account before remindedBefore and still haven't. Users who were
+// never reminded are kept, so nobody is deleted without a warning, and so are disabled accounts.
+// It returns how many were deleted.
+func (m UserModel) DeleteUnactivated(createdBefore, remindedBefore time.Time) (int64, error) {
+	query := `
+    DELETE FROM users
+    WHERE activated = false AND disabled_at IS NULL AND created_at < $1
+    AND activation_reminder_sent_at IS NOT NULL AND activation_reminder_sent_at < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, createdBefore, remindedBefore)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
 type password struct {
 	plaintext *string
 	hash      []byte
 }
 
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext version in the struct.
+// PasswordHasher hashes new passwords. It defaults to bcrypt at cost 12, and is replaced with
+// the configured hasher when the application starts.
+var PasswordHasher passhash.Hasher = passhash.Bcrypt{Cost: 12}
+
+// The Set() method calculates the hash of a plaintext password with PasswordHasher, and stores
+// both the hash and the plaintext version in the struct.
 
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := PasswordHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -145,19 +551,36 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 // The Matches() method will checks wheather the provided plaintext password matches the
-// hashes password stroed in the struct, returning true if matches.
+// hashes password stroed in the struct, returning true if matches. Hashes made with any
+// supported algorithm can be checked.
 
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
-	}
-	return true, nil
+	return passhash.Verify(p.hash, plaintextPassword)
+}
+
+// The Outdated() method reports whether the stored hash was made with a different algorithm or
+// different parameters than PasswordHasher uses now. The password should then be Set() again
+// the next time it is known, like on a successful login.
+func (p *password) Outdated() bool {
+	return PasswordHasher.Outdated(p.hash)
+}
+
+// dummyPasswordHash is only used by SimulatePasswordCheck(). It is generated the first time it
+// is needed, so it doesn't slow down starting the application.
+var (
+	dummyPasswordHash []byte
+	dummyPasswordOnce sync.Once
+)
+
+// SimulatePasswordCheck() takes about as long as password.Matches() does. Call it when there is
+// no user for an email address, so the response time doesn't give away whether the address
+// has an account.
+func SimulatePasswordCheck(plaintextPassword string) {
+	dummyPasswordOnce.Do(func() {
+		dummyPasswordHash, _ = PasswordHasher.Hash("greenlight dummy password")
+	})
+
+	passhash.Verify(dummyPasswordHash, plaintextPassword)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -168,7 +591,19 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePasswordPlainText(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "password must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= PasswordHasher.MaxLength(), "password", fmt.Sprintf("must not be more than %d bytes long", PasswordHasher.MaxLength()))
+}
+
+func ValidatePreferences(v *validator.Validator, preferences Preferences) {
+	v.Check(len(preferences) <= 50, "preferences", "must not contain more than 50 keys")
+
+	for key := range preferences {
+		v.Check(key != "", "preferences", "keys must not be empty")
+		v.Check(len(key) <= 100, "preferences", "keys must not be more than 100 bytes long")
+	}
+
+	js, err := json.Marshal(preferences)
+	v.Check(err == nil && len(js) <= 8192, "preferences", "must not be more than 8192 bytes long")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -178,6 +613,8 @@ func ValidateUser(v *validator.Validator, user *User) {
 	// Call the standalone ValidateEmail() helper,
 	ValidateEmail(v, user.Email)
 
+	ValidatePreferences(v, user.Preferences)
+
 	// If the plaintext password is not nil
 	if user.Password.plaintext != nil {
 		ValidatePasswordPlainText(v, *user.Password.plaintext)
@@ -188,22 +625,35 @@ func ValidateUser(v *validator.Validator, user *User) {
 	}
 }
 
+// The GetForToken() method returns the user an unexpired token of the given scope belongs to.
+// Tokens of disabled accounts are treated as if they don't exist.
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+	user, _, err := m.GetForTokenWithExpiry(tokenScope, tokenPlaintext)
+	return user, err
+}
+
+// The GetForTokenWithExpiry() method is GetForToken() which also returns when the token expires,
+// for callers which keep hold of the user for a while.
+func (m UserModel) GetForTokenWithExpiry(tokenScope, tokenPlaintext string) (*User, time.Time, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-    SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+    SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.preferences, users.deletion_scheduled_at, users.disabled_at, users.version, tokens.expiry
     FROM users
     INNER JOIN tokens
     ON users.id = tokens.user_id
     WHERE tokens.hash = $1
     AND tokens.scope = $2
-    AND tokens.expiry > $3`
+    AND tokens.expiry > $3
+    AND users.disabled_at IS NULL`
 
 	args := []any{tokenHash[:], tokenScope, time.Now()}
 
-	var user User
+	var (
+		user   User
+		expiry time.Time
+	)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -215,15 +665,19 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Preferences,
+		&user.DeletionScheduledAt,
+		&user.DisabledAt,
 		&user.Version,
+		&expiry,
 	)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
+			return nil, time.Time{}, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, time.Time{}, err
 		}
 	}
-	return &user, nil
+	return &user, expiry, nil
 }
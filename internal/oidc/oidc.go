@@ -0,0 +1,431 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+// Config holds the settings for a single OpenID Connect provider
+type Config struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+}
+
+// ParseConfig() parses a provider from a comma separated list of key=value pairs, e.g.
+// "name=google,issuer=https://accounts.google.com,client-id=...,client-secret=...,redirect-uri=..."
+func ParseConfig(spec string) (Config, error) {
+	var cfg Config
+
+	for _, pair := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid oidc provider setting %q", pair)
+		}
+
+		switch key {
+		case "name":
+			cfg.Name = value
+		case "issuer":
+			cfg.Issuer = strings.TrimSuffix(value, "/")
+		case "client-id":
+			cfg.ClientID = value
+		case "client-secret":
+			cfg.ClientSecret = value
+		case "redirect-uri":
+			cfg.RedirectURI = value
+		default:
+			return cfg, fmt.Errorf("unknown oidc provider setting %q", key)
+		}
+	}
+
+	if cfg.Name == "" || cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURI == "" {
+		return cfg, errors.New("oidc provider needs at least name, issuer, client-id and redirect-uri")
+	}
+
+	return cfg, nil
+}
+
+// Claims are the ID token claims we use
+type Claims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Audience      any    `json:"aud"`
+	ExpiresAt     int64  `json:"exp"`
+	Nonce         string `json:"nonce"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one OpenID Connect provider. The discovery document and signing keys are
+// fetched the first time they are needed and then cached. The keys are fetched again when a
+// token is signed by a key we haven't seen, which is how providers rotate them.
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *discovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// NewProvider() returns a Provider for the config. The provider doesn't make any requests until
+// it is used, so a provider which is down doesn't stop the API from starting.
+func NewProvider(cfg Config, client *http.Client) *Provider {
+	return &Provider{
+		Config: cfg,
+		client: client,
+	}
+}
+
+// GenerateVerifier() returns a random string suitable for a state, nonce or PKCE code verifier
+func GenerateVerifier() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// AuthCodeURL() returns the URL the user should be sent to, to log in at the provider
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURI)
+	params.Set("scope", "openid email profile")
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return d.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange() swaps an authorization code for the ID token, and verifies it. The nonce must be
+// the one that was sent with AuthCodeURL().
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURI)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", verifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var response struct {
+		IDToken string `json:"id_token"`
+	}
+
+	err = p.do(req, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.IDToken == "" {
+		return nil, errors.New("oidc token response has no id_token")
+	}
+
+	return p.verify(ctx, response.IDToken, nonce)
+}
+
+// verify() checks the signature and the claims of an ID token
+func (p *Provider) verify(ctx context.Context, idToken, nonce string) (*Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidIDToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	key, err := p.getKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	// Only the algorithms which match the type of the key are accepted
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Algorithm != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return nil, ErrInvalidIDToken
+		}
+	case *ecdsa.PublicKey:
+		if header.Algorithm != "ES256" || len(signature) != 64 {
+			return nil, ErrInvalidIDToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, ErrInvalidIDToken
+		}
+	default:
+		return nil, ErrInvalidIDToken
+	}
+
+	var claims Claims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	if claims.Issuer != p.Issuer || claims.Subject == "" || !claims.hasAudience(p.ClientID) {
+		return nil, ErrInvalidIDToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt || claims.Nonce != nonce {
+		return nil, ErrInvalidIDToken
+	}
+
+	return &claims, nil
+}
+
+// hasAudience() checks the aud claim, which may be a single string or a list of strings
+func (c Claims) hasAudience(clientID string) bool {
+	switch aud := c.Audience.(type) {
+	case string:
+		return aud == clientID
+	case []any:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var d discovery
+	err = p.do(req, &d)
+	if err != nil {
+		return nil, err
+	}
+
+	// The issuer in the document must be the one we were configured with (OIDC Discovery 4.3)
+	if strings.TrimSuffix(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc discovery issuer %q does not match %q", d.Issuer, p.Issuer)
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *Provider) getKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	// Don't let tokens with made-up key ids make us hammer the provider
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, ErrInvalidIDToken
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	err = p.do(req, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysFetched = time.Now()
+
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			// skip key types we don't support
+			continue
+		}
+		p.keys[k.KeyID] = key
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, ErrInvalidIDToken
+	}
+	return key, nil
+}
+
+// do() sends the request and decodes the JSON response into dst
+func (p *Provider) do(req *http.Request, dst any) error {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1_048_576))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc request to %s failed with status %d", req.URL.Redacted(), res.StatusCode)
+	}
+
+	return json.Unmarshal(body, dst)
+}
+
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, errors.New("not a signing key")
+	}
+
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return key, nil
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+}
+
+func decodeSegment(s string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
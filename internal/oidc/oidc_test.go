@@ -0,0 +1,398 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID    = "greenlight"
+	testRedirectURI = "https://greenlight.example/callback"
+	testCode        = "authorization-code"
+	testNonce       = "nonce-value"
+)
+
+// stubIssuer is a local OpenID Connect provider serving the discovery document, the JWKS and a
+// token endpoint, which returns idToken for a code exchanged with the right PKCE verifier.
+type stubIssuer struct {
+	*httptest.Server
+	t *testing.T
+
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	// issuer is what the discovery document claims, the server's own URL unless changed
+	issuer    string
+	challenge string
+	idToken   string
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stubIssuer{t: t, rsaKey: rsaKey, ecKey: ecKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discoveryHandler)
+	mux.HandleFunc("/jwks", s.jwksHandler)
+	mux.HandleFunc("/token", s.tokenHandler)
+
+	s.Server = httptest.NewServer(mux)
+	s.issuer = s.URL
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *stubIssuer) provider() *Provider {
+	return NewProvider(Config{
+		Name:        "stub",
+		Issuer:      s.URL,
+		ClientID:    testClientID,
+		RedirectURI: testRedirectURI,
+	}, s.Client())
+}
+
+func (s *stubIssuer) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, map[string]string{
+		"issuer":                 s.issuer,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+func (s *stubIssuer) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+	s.writeJSON(w, map[string]any{"keys": []map[string]string{
+		{
+			"kty": "RSA",
+			"kid": "rsa-key",
+			"use": "sig",
+			"n":   encode(s.rsaKey.N.Bytes()),
+			"e":   encode(big.NewInt(int64(s.rsaKey.E)).Bytes()),
+		},
+		{
+			"kty": "EC",
+			"kid": "ec-key",
+			"crv": "P-256",
+			"x":   encode(s.ecKey.X.FillBytes(make([]byte, 32))),
+			"y":   encode(s.ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	}})
+}
+
+func (s *stubIssuer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+
+	if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != testCode ||
+		r.PostForm.Get("client_id") != testClientID || r.PostForm.Get("redirect_uri") != testRedirectURI ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != s.challenge {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	s.writeJSON(w, map[string]string{"id_token": s.idToken, "token_type": "Bearer"})
+}
+
+func (s *stubIssuer) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		s.t.Error(err)
+	}
+}
+
+// claims returns valid ID token claims, for the tests to change
+func (s *stubIssuer) claims() map[string]any {
+	return map[string]any{
+		"iss":            s.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          testNonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+// sign() returns an ID token for the claims, signed by the issuer's key for kid. The header
+// says alg, whichever key signed it.
+func (s *stubIssuer) sign(alg, kid string, claims map[string]any) string {
+	s.t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+
+	switch kid {
+	case "ec-key":
+		r, sig, err := ecdsa.Sign(rand.Reader, s.ecKey, digest[:])
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	default:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			s.t.Fatal(err)
+		}
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// login() runs the flow against the issuer: it builds the authorization URL, as the user would
+// be sent to, then exchanges the code for the issuer's current ID token.
+func (s *stubIssuer) login(p *Provider) (*Claims, error) {
+	s.t.Helper()
+
+	verifier, err := GenerateVerifier()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	authURL, err := p.AuthCodeURL(context.Background(), "state", testNonce, verifier)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	if u.Query().Get("code_challenge_method") != "S256" || u.Query().Get("nonce") != testNonce {
+		s.t.Fatalf("unexpected authorization url %s", authURL)
+	}
+
+	s.challenge = u.Query().Get("code_challenge")
+
+	return p.Exchange(context.Background(), testCode, verifier, testNonce)
+}
+
+func TestExchange(t *testing.T) {
+	issuer := newStubIssuer(t)
+
+	tests := []struct {
+		name  string
+		token func() string
+		valid bool
+	}{
+		{
+			name:  "RS256",
+			token: func() string { return issuer.sign("RS256", "rsa-key", issuer.claims()) },
+			valid: true,
+		},
+		{
+			name:  "ES256",
+			token: func() string { return issuer.sign("ES256", "ec-key", issuer.claims()) },
+			valid: true,
+		},
+		{
+			name: "audience list",
+			token: func() string {
+				claims := issuer.claims()
+				claims["aud"] = []string{"someone-else", testClientID}
+				return issuer.sign("RS256", "rsa-key", claims)
+			},
+			valid: true,
+		},
+		{
+			name: "bad aud",
+			token: func() string {
+				claims := issuer.claims()
+				claims["aud"] = "someone-else"
+				return issuer.sign("RS256", "rsa-key", claims)
+			},
+		},
+		{
+			name: "bad iss",
+			token: func() string {
+				claims := issuer.claims()
+				claims["iss"] = "https://evil.example"
+				return issuer.sign("RS256", "rsa-key", claims)
+			},
+		},
+		{
+			name: "missing sub",
+			token: func() string {
+				claims := issuer.claims()
+				delete(claims, "sub")
+				return issuer.sign("RS256", "rsa-key", claims)
+			},
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := issuer.claims()
+				claims["exp"] = time.Now().Add(-time.Minute).Unix()
+				return issuer.sign("RS256", "rsa-key", claims)
+			},
+		},
+		{
+			name: "nonce mismatch",
+			token: func() string {
+				claims := issuer.claims()
+				claims["nonce"] = "another-nonce"
+				return issuer.sign("RS256", "rsa-key", claims)
+			},
+		},
+		{
+			name:  "unknown kid",
+			token: func() string { return issuer.sign("RS256", "unknown-key", issuer.claims()) },
+		},
+		{
+			name:  "alg mismatch",
+			token: func() string { return issuer.sign("ES256", "rsa-key", issuer.claims()) },
+		},
+		{
+			name:  "alg none",
+			token: func() string { return issuer.sign("none", "rsa-key", issuer.claims()) },
+		},
+		{
+			name: "tampered claims",
+			token: func() string {
+				token := strings.Split(issuer.sign("RS256", "rsa-key", issuer.claims()), ".")
+
+				claims := issuer.claims()
+				claims["sub"] = "user-2"
+				tampered := strings.Split(issuer.sign("RS256", "rsa-key", claims), ".")
+
+				return token[0] + "." + tampered[1] + "." + token[2]
+			},
+		},
+		{
+			name: "signed by another key",
+			token: func() string {
+				claims := issuer.claims()
+				original := issuer.rsaKey
+				other, err := rsa.GenerateKey(rand.Reader, 2048)
+				if err != nil {
+					t.Fatal(err)
+				}
+				issuer.rsaKey = other
+				defer func() { issuer.rsaKey = original }()
+				return issuer.sign("RS256", "rsa-key", claims)
+			},
+		},
+		{
+			name:  "malformed",
+			token: func() string { return "not.a-jwt" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer.idToken = tt.token()
+
+			claims, err := issuer.login(issuer.provider())
+
+			if !tt.valid {
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Fatalf("got error %v, want %v", err, ErrInvalidIDToken)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Issuer != issuer.URL || claims.Subject != "user-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	issuer := newStubIssuer(t)
+	issuer.idToken = issuer.sign("RS256", "rsa-key", issuer.claims())
+
+	p := issuer.provider()
+
+	_, err := issuer.login(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the code can't be exchanged without the verifier the challenge was made from
+	_, err = p.Exchange(context.Background(), testCode, "not-the-verifier", testNonce)
+	if err == nil {
+		t.Fatal("exchange with the wrong code verifier succeeded")
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	issuer := newStubIssuer(t)
+	issuer.issuer = "https://evil.example"
+
+	_, err := issuer.provider().AuthCodeURL(context.Background(), "state", testNonce, "verifier")
+	if err == nil {
+		t.Fatal("discovery document with another issuer was accepted")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig("name=stub, issuer=https://issuer.example/, client-id=id, client-secret=secret, redirect-uri=https://app.example/cb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Name != "stub" || cfg.Issuer != "https://issuer.example" || cfg.ClientID != "id" || cfg.ClientSecret != "secret" || cfg.RedirectURI != "https://app.example/cb" {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	for _, spec := range []string{"name=stub", "name=stub,issuer=x,client-id=y,redirect-uri=z,colour=blue", "name"} {
+		if _, err := ParseConfig(spec); err == nil {
+			t.Errorf("ParseConfig(%q) succeeded", spec)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Package passhash hashes passwords with bcrypt or argon2id. Hashes are self-describing: bcrypt
+// hashes use the usual $2a$ format and argon2id hashes use the PHC string format, so a hash
+// can always be verified, whichever algorithm and parameters are configured today.
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownFormat = errors.New("passhash: unknown hash format")
+
+// Hasher creates password hashes with one algorithm and set of parameters.
+type Hasher interface {
+	// Hash() returns the encoded hash of a password.
+	Hash(plaintext string) ([]byte, error)
+	// Outdated() reports whether a hash was made with another algorithm or other parameters,
+	// and should be replaced by a new one the next time the password is known.
+	Outdated(hash []byte) bool
+	// MaxLength() returns the longest password in bytes the hasher supports.
+	MaxLength() int
+}
+
+// Verify() reports whether the plaintext password matches an encoded hash of either format.
+func Verify(hash []byte, plaintext string) (bool, error) {
+	switch {
+	case isBcrypt(hash):
+		err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, nil
+			default:
+				return false, err
+			}
+		}
+		return true, nil
+	case strings.HasPrefix(string(hash), "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+
+		other := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	default:
+		return false, ErrUnknownFormat
+	}
+}
+
+func isBcrypt(hash []byte) bool {
+	return strings.HasPrefix(string(hash), "$2a$") || strings.HasPrefix(string(hash), "$2b$") || strings.HasPrefix(string(hash), "$2y$")
+}
+
+// Bcrypt hashes passwords with bcrypt at the given cost.
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), b.Cost)
+}
+
+func (b Bcrypt) Outdated(hash []byte) bool {
+	if !isBcrypt(hash) {
+		return true
+	}
+
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != b.Cost
+}
+
+// bcrypt only uses the first 72 bytes of a password, and x/crypto refuses longer ones.
+func (b Bcrypt) MaxLength() int {
+	return 72
+}
+
+// Argon2id hashes passwords with argon2id. Memory is in KiB.
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2id holds the parameters OWASP recommends as a minimum.
+var DefaultArgon2id = Argon2id{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func (a Argon2id) Hash(plaintext string) ([]byte, error) {
+	salt := make([]byte, a.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	return []byte(encoded), nil
+}
+
+func (a Argon2id) Outdated(hash []byte) bool {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory != a.Memory || params.Iterations != a.Iterations || params.Parallelism != a.Parallelism ||
+		uint32(len(salt)) != a.SaltLength || uint32(len(key)) != a.KeyLength
+}
+
+// argon2id has no length limit of its own, this just stops huge passwords from being used to
+// tie up the server.
+func (a Argon2id) MaxLength() int {
+	return 1024
+}
+
+// decodeArgon2id() parses a PHC string like $argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>
+func decodeArgon2id(hash []byte) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownFormat
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownFormat
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, ErrUnknownFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownFormat
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownFormat
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
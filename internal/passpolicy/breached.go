@@ -0,0 +1,81 @@
+package passpolicy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// BreachedList holds the SHA-1 hashes of passwords known to have appeared in data breaches.
+// Like the Have I Been Pwned range API, hashes are grouped by their first 5 hex characters, so
+// a lookup only searches the few suffixes that share the password's prefix.
+type BreachedList struct {
+	ranges map[string][]string
+	count  int
+}
+
+// LoadBreachedList() reads a breached password file. Each line holds an uppercase or lowercase
+// hex SHA-1 hash, optionally followed by a colon and a count, which is the format of the Have I
+// Been Pwned downloads. Blank lines and lines starting with # are skipped.
+func LoadBreachedList(path string) (*BreachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := &BreachedList{ranges: make(map[string][]string)}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(text, ":")
+		hash = strings.ToUpper(hash)
+
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha1.Size {
+			return nil, fmt.Errorf("%s:%d: invalid SHA-1 hash", path, line)
+		}
+
+		list.ranges[hash[:5]] = append(list.ranges[hash[:5]], hash[5:])
+		list.count++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for prefix := range list.ranges {
+		slices.Sort(list.ranges[prefix])
+	}
+
+	return list, nil
+}
+
+// Contains() reports whether the password is on the list.
+func (l *BreachedList) Contains(password string) bool {
+	if l == nil {
+		return false
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	_, found := slices.BinarySearch(l.ranges[hash[:5]], hash[5:])
+	return found
+}
+
+// Len() returns the number of hashes on the list.
+func (l *BreachedList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return l.count
+}
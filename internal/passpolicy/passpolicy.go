@@ -0,0 +1,47 @@
+// Package passpolicy decides whether a password is good enough to use. It rejects passwords
+// which contain the user's name or email address, which have appeared in a data breach, or
+// which are too easy to guess according to a zxcvbn-style strength estimate.
+package passpolicy
+
+import "strings"
+
+// Policy holds the password rules. A nil Breached list skips the breach check.
+type Policy struct {
+	MinScore int
+	Breached *BreachedList
+}
+
+// Check() returns a message explaining why the password can't be used, or "" if it can.
+// userInputs are things like the user's name and email address.
+func (p *Policy) Check(password string, userInputs ...string) string {
+	lower := strings.ToLower(password)
+	for _, token := range userTokens(userInputs) {
+		if strings.Contains(lower, token) {
+			return "must not contain your name or email address"
+		}
+	}
+
+	if p.Breached.Contains(password) {
+		return "has appeared in a data breach and must not be used"
+	}
+
+	estimate := EstimateStrength(password, userInputs...)
+	if estimate.Score >= p.MinScore {
+		return ""
+	}
+
+	switch estimate.Pattern {
+	case patternDictionary:
+		return "is too easy to guess, avoid common passwords and words"
+	case patternRepeat:
+		return "is too easy to guess, avoid repeated characters like aaa"
+	case patternSequence:
+		return "is too easy to guess, avoid sequences like abc or 123"
+	case patternKeyboard:
+		return "is too easy to guess, avoid rows of keys like qwerty"
+	case patternYear:
+		return "is too easy to guess, avoid years and dates"
+	default:
+		return "is too easy to guess, use a longer password or a few unrelated words"
+	}
+}
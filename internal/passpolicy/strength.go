@@ -0,0 +1,299 @@
+package passpolicy
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// The kinds of pattern the estimator recognises, used to explain why a password is weak.
+const (
+	patternBruteForce = "bruteforce"
+	patternDictionary = "dictionary"
+	patternUserInput  = "user input"
+	patternRepeat     = "repeat"
+	patternSequence   = "sequence"
+	patternKeyboard   = "keyboard"
+	patternYear       = "year"
+)
+
+// Estimate is the result of estimating how hard a password is to guess. Bits is the base-2
+// logarithm of the number of guesses an attacker who knows the common patterns would need, and
+// Score buckets it from 0 (trivial) to 4 (very hard) like zxcvbn does.
+type Estimate struct {
+	Bits  float64
+	Score int
+	// Pattern is the weakest kind of pattern the password was built from, or "" if it looks
+	// random.
+	Pattern string
+}
+
+// The score thresholds, in bits. They are zxcvbn's 10^3, 10^6, 10^8 and 10^10 guesses.
+var scoreThresholds = []float64{10, 20, 26.6, 33.2}
+
+// commonPasswords holds very common passwords and words, most common first. The position of a
+// word in the list is used as the number of guesses needed to find it.
+var commonPasswords = strings.Fields(`
+password 123456 12345678 qwerty abc123 123456789 111111 1234567 iloveyou adobe123 123123
+admin 1234567890 letmein photoshop 1234 monkey shadow sunshine 12345 password1 princess
+azerty trustno1 000000 welcome dragon football baseball master michael superman batman
+jennifer hunter ashley bailey passw0rd charlie donald freedom whatever qazwsx mustang
+starwars secret login hello solo access flower hottie loveme zaq1zaq1 654321 jordan
+harley ranger buster thomas tigger robert soccer hockey killer george sexy andrew pepper
+daniel joshua maggie biteme summer winter spring autumn computer internet samsung apple
+google facebook love money family friends forever cheese chocolate orange banana purple
+yellow silver golden diamond matrix hello123 test test123 guest user root changeme
+default greenlight movie movies cinema film films netflix
+`)
+
+var commonRanks = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, word := range commonPasswords {
+		if _, found := ranks[word]; !found {
+			ranks[word] = i + 1
+		}
+	}
+	return ranks
+}()
+
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm", "qwertzuiop", "azertyuiop"}
+
+var leet = strings.NewReplacer("@", "a", "4", "a", "8", "b", "3", "e", "6", "g", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t", "2", "z")
+
+// A match is a part of the password, password[i:j], which follows a pattern
+type match struct {
+	i, j    int
+	bits    float64
+	pattern string
+}
+
+// EstimateStrength() estimates how hard the password is to guess. userInputs are words like
+// the user's name and email address, which an attacker would try first.
+func EstimateStrength(password string, userInputs ...string) Estimate {
+	runes := []rune(password)
+	n := len(runes)
+
+	if n == 0 {
+		return Estimate{Pattern: patternBruteForce}
+	}
+
+	userRanks := make(map[string]int)
+	for _, token := range userTokens(userInputs) {
+		userRanks[token] = 1
+	}
+
+	matches := findMatches(runes, userRanks)
+	bruteBits := math.Log2(float64(charsetSize(runes)))
+
+	// best[j] is the fewest bits needed to guess runes[:j], found by trying every way of
+	// splitting the password into patterns and brute forced characters
+	best := make([]float64, n+1)
+	last := make([]*match, n+1)
+	for j := 1; j <= n; j++ {
+		best[j] = best[j-1] + bruteBits
+		last[j] = nil
+
+		for k := range matches {
+			m := &matches[k]
+			if m.j != j {
+				continue
+			}
+
+			// every extra pattern costs the attacker a little, for trying the combinations
+			bits := best[m.i] + m.bits + 1
+			if bits < best[j] {
+				best[j] = bits
+				last[j] = m
+			}
+		}
+	}
+
+	estimate := Estimate{Bits: best[n]}
+	for _, threshold := range scoreThresholds {
+		if estimate.Bits >= threshold {
+			estimate.Score++
+		}
+	}
+
+	// report the pattern which covers most of the password
+	covered := make(map[string]int)
+	for j := n; j > 0; {
+		if m := last[j]; m != nil {
+			covered[m.pattern] += m.j - m.i
+			j = m.i
+		} else {
+			j--
+		}
+	}
+	for pattern, length := range covered {
+		if estimate.Pattern == "" || length > covered[estimate.Pattern] {
+			estimate.Pattern = pattern
+		}
+	}
+
+	return estimate
+}
+
+// findMatches() returns every part of the password which follows one of the patterns
+func findMatches(runes []rune, userRanks map[string]int) []match {
+	var matches []match
+	n := len(runes)
+
+	lower := []rune(strings.ToLower(string(runes)))
+
+	// dictionary words, allowing for capitals and common letter substitutions
+	for i := 0; i < n; i++ {
+		for j := i + 3; j <= n && j-i <= 20; j++ {
+			word := string(lower[i:j])
+			plain := leet.Replace(word)
+
+			extra := 0.0
+			if string(runes[i:j]) != word {
+				extra++
+			}
+			if plain != word {
+				extra++
+			}
+
+			if rank, found := userRanks[plain]; found {
+				matches = append(matches, match{i, j, math.Log2(float64(rank)) + extra, patternUserInput})
+			} else if rank, found := commonRanks[plain]; found {
+				matches = append(matches, match{i, j, math.Log2(float64(rank)) + extra, patternDictionary})
+			}
+		}
+	}
+
+	// runs of the same character
+	for i := 0; i < n; {
+		j := i + 1
+		for j < n && lower[j] == lower[i] {
+			j++
+		}
+		if j-i >= 3 {
+			bits := math.Log2(float64(charsetSize(runes[i:i+1]))) + math.Log2(float64(j-i))
+			matches = append(matches, match{i, j, bits, patternRepeat})
+		}
+		i = j
+	}
+
+	// sequences like abcd, 9876 or 2468
+	for i := 0; i+2 < n; {
+		step := lower[i+1] - lower[i]
+		j := i + 2
+		for j < n && lower[j]-lower[j-1] == step {
+			j++
+		}
+		if step != 0 && (step >= -2 && step <= 2) && j-i >= 3 {
+			bits := math.Log2(float64(charsetSize(runes[i:i+1]))) + math.Log2(float64(j-i)) + 1
+			matches = append(matches, match{i, j, bits, patternSequence})
+			i = j - 1
+			continue
+		}
+		i++
+	}
+
+	// straight runs along a keyboard row
+	for i := 0; i < n; i++ {
+		for j := min(n, i+10); j >= i+4; j-- {
+			part := string(lower[i:j])
+			found := false
+			for _, row := range keyboardRows {
+				if strings.Contains(row, part) {
+					found = true
+					break
+				}
+			}
+			if found {
+				matches = append(matches, match{i, j, math.Log2(float64(len(keyboardRows)*10)) + math.Log2(float64(j-i)), patternKeyboard})
+				break
+			}
+		}
+	}
+
+	// years, which people love to append
+	for i := 0; i+4 <= n; i++ {
+		part := string(runes[i : i+4])
+		if (strings.HasPrefix(part, "19") || strings.HasPrefix(part, "20")) && isDigits(part) {
+			matches = append(matches, match{i, i + 4, math.Log2(200), patternYear})
+		}
+	}
+
+	return matches
+}
+
+// charsetSize() returns how many different characters an attacker has to try for each
+// position, based on the kinds of character used
+func charsetSize(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	if lower {
+		size += 26
+	}
+	if upper {
+		size += 26
+	}
+	if digit {
+		size += 10
+	}
+	if symbol {
+		size += 33
+	}
+	if other {
+		size += 100
+	}
+
+	return size
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// userTokens() splits user inputs like "Jane Doe" or "jane.doe@example.com" into the lowercase
+// words an attacker would try (jane, doe and jane.doe), ignoring words too short to matter
+func userTokens(userInputs []string) []string {
+	var tokens []string
+
+	for _, input := range userInputs {
+		input = strings.ToLower(input)
+
+		// only the local part of an email address says anything about the user
+		if local, _, found := strings.Cut(input, "@"); found {
+			input = local
+			if len(local) >= 3 {
+				tokens = append(tokens, local)
+			}
+		}
+
+		for _, token := range strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if len(token) >= 3 {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+
+	return tokens
+}
@@ -0,0 +1,175 @@
+package webauthn
+
+import (
+	"errors"
+	"math"
+)
+
+// Authenticators encode attestation objects and public keys in CBOR (RFC 8949). We only need to
+// read them, and only the definite-length subset WebAuthn requires (CTAP2 canonical CBOR), so this
+// is a small decoder rather than a general purpose library.
+
+// Nesting limit, real attestation objects are only a few levels deep
+const cborMaxDepth = 16
+
+var errCBOR = errors.New("invalid cbor")
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// decodeCBOR() decodes the first CBOR item in data, returning it along with the number of bytes
+// it took up. Integers are returned as int64, byte strings as []byte, text strings as string,
+// arrays as []any and maps as map[any]any with int64 or string keys.
+func decodeCBOR(data []byte) (any, int, error) {
+	d := &cborDecoder{data: data}
+
+	value, err := d.decode(0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, d.pos, nil
+}
+
+func (d *cborDecoder) decode(depth int) (any, error) {
+	if depth > cborMaxDepth || d.pos >= len(d.data) {
+		return nil, errCBOR
+	}
+
+	initial := d.data[d.pos]
+	d.pos++
+
+	major, info := initial>>5, initial&0x1f
+
+	// Simple values and floats use the additional info differently from everything else
+	if major == 7 {
+		return d.decodeSimple(info)
+	}
+
+	arg, err := d.argument(info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, errCBOR
+		}
+		return int64(arg), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errCBOR
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		b, err := d.bytes(arg)
+		if err != nil {
+			return nil, err
+		}
+		if major == 3 {
+			return string(b), nil
+		}
+		return b, nil
+	case 4:
+		// every item takes at least one byte, which stops huge lengths from allocating
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBOR
+		}
+
+		items := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case 5:
+		if arg > uint64(len(d.data)-d.pos)/2 {
+			return nil, errCBOR
+		}
+
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, errCBOR
+			}
+
+			if _, exists := m[key]; exists {
+				return nil, errCBOR
+			}
+
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	default:
+		// tags (major type 6) never appear in WebAuthn data
+		return nil, errCBOR
+	}
+}
+
+// argument() reads the length or value which follows the initial byte of an item
+func (d *cborDecoder) argument(info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+
+		b, err := d.bytes(uint64(size))
+		if err != nil {
+			return 0, err
+		}
+
+		var arg uint64
+		for _, c := range b {
+			arg = arg<<8 | uint64(c)
+		}
+		return arg, nil
+	default:
+		// 28-30 are reserved and 31 is for indefinite lengths, which we don't accept
+		return 0, errCBOR
+	}
+}
+
+// decodeSimple() decodes the simple values. Floats never appear in WebAuthn data, so they are
+// rejected along with everything else.
+func (d *cborDecoder) decodeSimple(info byte) (any, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	default:
+		return nil, errCBOR
+	}
+}
+
+// bytes() returns the next n bytes of the input
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errCBOR
+	}
+
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+
+	return b, nil
+}
@@ -0,0 +1,181 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// cborPair is a map entry for encodeCBOR(), which keeps map keys in the order given
+type cborPair struct {
+	key   any
+	value any
+}
+
+// encodeCBOR() encodes the definite-length CBOR the decoder accepts, so the tests can build
+// attestation objects and COSE keys by hand. Maps are written as []cborPair.
+func encodeCBOR(v any) []byte {
+	switch v := v.(type) {
+	case int:
+		return encodeCBOR(int64(v))
+	case int64:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []any:
+		b := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			b = append(b, encodeCBOR(item)...)
+		}
+		return b
+	case []cborPair:
+		b := cborHead(5, uint64(len(v)))
+		for _, pair := range v {
+			b = append(b, encodeCBOR(pair.key)...)
+			b = append(b, encodeCBOR(pair.value)...)
+		}
+		return b
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case nil:
+		return []byte{0xf6}
+	default:
+		panic("encodeCBOR: unsupported type")
+	}
+}
+
+// cborHead() returns the initial byte and argument of an item, in the shortest form
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= math.MaxUint8:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major<<5 | 27}, n)
+	}
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  any
+	}{
+		{name: "small int", input: []byte{0x17}, want: int64(23)},
+		{name: "one byte int", input: []byte{0x18, 0x18}, want: int64(24)},
+		{name: "eight byte int", input: []byte{0x1b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, want: int64(math.MaxInt64)},
+		{name: "negative int", input: []byte{0x38, 0xff}, want: int64(-256)},
+		{name: "smallest negative int", input: []byte{0x3b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, want: int64(math.MinInt64)},
+		{name: "byte string", input: []byte{0x43, 1, 2, 3}, want: []byte{1, 2, 3}},
+		{name: "empty byte string", input: []byte{0x40}, want: []byte{}},
+		{name: "text string", input: append([]byte{0x64}, "fido"...), want: "fido"},
+		{name: "array", input: []byte{0x83, 0x01, 0x20, 0xf5}, want: []any{int64(1), int64(-1), true}},
+		{name: "map", input: encodeCBOR([]cborPair{{"fmt", "none"}, {1, 2}, {-1, []byte{9}}}), want: map[any]any{"fmt": "none", int64(1): int64(2), int64(-1): []byte{9}}},
+		{name: "false", input: []byte{0xf4}, want: false},
+		{name: "null", input: []byte{0xf6}, want: nil},
+		{name: "undefined", input: []byte{0xf7}, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, n, err := decodeCBOR(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != len(tt.input) {
+				t.Errorf("decoded %d bytes, want %d", n, len(tt.input))
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORTrailingData(t *testing.T) {
+	// only the first item is decoded, the callers check n to reject what follows it
+	_, n, err := decodeCBOR([]byte{0x01, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("decoded %d bytes, want 1", n)
+	}
+}
+
+func TestDecodeCBORInvalid(t *testing.T) {
+	// 17 nested arrays, one more than cborMaxDepth allows below the top level
+	deep := append(bytes.Repeat([]byte{0x81}, cborMaxDepth+1), 0x00)
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "empty", input: []byte{}},
+		{name: "indefinite byte string", input: []byte{0x5f, 0x41, 0x01, 0xff}},
+		{name: "indefinite text string", input: []byte{0x7f, 0x61, 0x61, 0xff}},
+		{name: "indefinite array", input: []byte{0x9f, 0x01, 0xff}},
+		{name: "indefinite map", input: []byte{0xbf, 0x01, 0x02, 0xff}},
+		{name: "break", input: []byte{0xff}},
+		{name: "duplicate int key", input: []byte{0xa2, 0x01, 0x01, 0x01, 0x02}},
+		{name: "duplicate text key", input: encodeCBOR([]cborPair{{"authData", []byte{1}}, {"authData", []byte{2}}})},
+		{name: "byte string key", input: []byte{0xa1, 0x41, 0x01, 0x01}},
+		{name: "array key", input: []byte{0xa1, 0x80, 0x01}},
+		{name: "oversized byte string", input: []byte{0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{name: "byte string longer than input", input: []byte{0x45, 0x01, 0x02}},
+		{name: "oversized text string", input: []byte{0x7a, 0xff, 0xff, 0xff, 0xff, 0x61}},
+		{name: "oversized array", input: []byte{0x9b, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		{name: "array longer than input", input: []byte{0x83, 0x01, 0x02}},
+		{name: "oversized map", input: []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0x01}},
+		{name: "map longer than input", input: []byte{0xa2, 0x01, 0x01}},
+		{name: "truncated argument", input: []byte{0x19, 0x01}},
+		{name: "int overflow", input: []byte{0x1b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{name: "negative int overflow", input: []byte{0x3b, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{name: "reserved info 28", input: []byte{0x1c}},
+		{name: "reserved info 29", input: []byte{0x5d}},
+		{name: "reserved info 30", input: []byte{0x9e}},
+		{name: "tag", input: []byte{0xc2, 0x41, 0x01}},
+		{name: "half float", input: []byte{0xf9, 0x3c, 0x00}},
+		{name: "single float", input: []byte{0xfa, 0x3f, 0x80, 0x00, 0x00}},
+		{name: "double float", input: []byte{0xfb, 0x3f, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{name: "simple value", input: []byte{0xf8, 0x20}},
+		{name: "too deep", input: deep},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeCBOR(tt.input)
+			if !errors.Is(err, errCBOR) {
+				t.Fatalf("got error %v, want %v", err, errCBOR)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORMaxDepth(t *testing.T) {
+	input := append(bytes.Repeat([]byte{0x81}, cborMaxDepth), 0x00)
+
+	_, _, err := decodeCBOR(input)
+	if err != nil {
+		t.Fatalf("nesting %d levels deep was rejected: %v", cborMaxDepth, err)
+	}
+}
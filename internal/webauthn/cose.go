@@ -0,0 +1,131 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+)
+
+// The COSE algorithms (RFC 9053) we accept for passkeys, in order of preference. Together these
+// cover every platform and security key authenticator in use.
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+var Algorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters and values (RFC 9052 section 7 and RFC 9053 section 7)
+const (
+	coseKty = 1
+	coseAlg = 3
+
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+	coseN   = -1
+	coseE   = -2
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// publicKey is a parsed COSE public key
+type publicKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+// parsePublicKey() parses a COSE_Key, as stored in the credential public key of a passkey
+func parsePublicKey(cose []byte) (*publicKey, error) {
+	value, n, err := decodeCBOR(cose)
+	if err != nil || n != len(cose) {
+		return nil, ErrInvalidCredential
+	}
+
+	m, ok := value.(map[any]any)
+	if !ok {
+		return nil, ErrInvalidCredential
+	}
+
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+
+	switch {
+	case alg == AlgES256 && kty == coseKtyEC2:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, ErrInvalidCredential
+		}
+
+		// make sure the point is actually on the curve
+		point := append(append([]byte{0x04}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, ErrInvalidCredential
+		}
+
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		return &publicKey{alg: alg, key: key}, nil
+	case alg == AlgEdDSA && kty == coseKtyOKP:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, ErrInvalidCredential
+		}
+
+		return &publicKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case alg == AlgRS256 && kty == coseKtyRSA:
+		n, _ := m[int64(coseN)].([]byte)
+		e, _ := m[int64(coseE)].([]byte)
+
+		if len(e) == 0 || len(e) > 4 {
+			return nil, ErrInvalidCredential
+		}
+
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		modulus := new(big.Int).SetBytes(n)
+
+		if modulus.BitLen() < 2048 || exponent < 3 || exponent%2 == 0 {
+			return nil, ErrInvalidCredential
+		}
+
+		return &publicKey{alg: alg, key: &rsa.PublicKey{N: modulus, E: exponent}}, nil
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+}
+
+// verify() checks the signature over message with the key's algorithm
+func (k *publicKey) verify(message, signature []byte) bool {
+	switch key := k.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return ecdsa.VerifyASN1(key, digest[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	default:
+		return false
+	}
+}
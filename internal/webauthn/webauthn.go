@@ -0,0 +1,366 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCredential    = errors.New("invalid credential")
+	ErrUnsupportedAlgorithm = errors.New("unsupported credential algorithm")
+	// ErrClonedAuthenticator is returned when the signature counter of an authenticator went
+	// backwards, which means there is more than one copy of its private key
+	ErrClonedAuthenticator = errors.New("authenticator signature counter went backwards")
+)
+
+// Encoding used for every binary value in the JSON sent to and from the browser
+var Encoding = base64.RawURLEncoding
+
+// Flags in the authenticator data (WebAuthn section 6.1)
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+	flagExtensions   = 0x80
+)
+
+// RelyingParty describes our side of the ceremonies. ID is the domain the passkeys are bound to,
+// and Origins are the web origins (like https://example.com) allowed to use them.
+type RelyingParty struct {
+	ID      string
+	Name    string
+	Origins []string
+}
+
+// Validate() checks that every origin is on the relying party domain or one of its subdomains,
+// since browsers refuse to use a passkey anywhere else
+func (rp RelyingParty) Validate() error {
+	if rp.ID == "" || len(rp.Origins) == 0 {
+		return errors.New("webauthn relying party needs an id and at least one origin")
+	}
+
+	for _, origin := range rp.Origins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("invalid webauthn origin %q", origin)
+		}
+
+		host := u.Hostname()
+		if host != rp.ID && !strings.HasSuffix(host, "."+rp.ID) {
+			return fmt.Errorf("webauthn origin %q is not on %q", origin, rp.ID)
+		}
+	}
+
+	return nil
+}
+
+// Credential is a passkey which has just been registered
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+}
+
+// CredentialDescriptor identifies a passkey in the options sent to the browser
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+// CreationOptions are the options for navigator.credentials.create(), in the JSON form of
+// WebAuthn Level 3 (PublicKeyCredentialCreationOptionsJSON)
+type CreationOptions struct {
+	Challenge string `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// RequestOptions are the options for navigator.credentials.get(), in the JSON form of WebAuthn
+// Level 3 (PublicKeyCredentialRequestOptionsJSON)
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationOptions() returns the options for registering a new passkey for a user. The
+// passkey is discoverable where possible, so the user can log in without typing their email
+// address, and user verification (a PIN or biometric) is always required.
+func (rp RelyingParty) CreationOptions(challenge string, userHandle []byte, name, displayName string, exclude [][]byte, timeout time.Duration) *CreationOptions {
+	options := &CreationOptions{
+		Challenge:          challenge,
+		Timeout:            timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(exclude),
+		Attestation:        "none",
+	}
+
+	options.RP.ID = rp.ID
+	options.RP.Name = rp.Name
+	options.User.ID = Encoding.EncodeToString(userHandle)
+	options.User.Name = name
+	options.User.DisplayName = displayName
+	options.AuthenticatorSelection.ResidentKey = "preferred"
+	options.AuthenticatorSelection.UserVerification = "required"
+
+	for _, alg := range Algorithms {
+		options.PubKeyCredParams = append(options.PubKeyCredParams, credentialParameter{Type: "public-key", Alg: alg})
+	}
+
+	return options
+}
+
+// RequestOptions() returns the options for logging in with a passkey. With no allowed
+// credentials the browser offers every passkey it has for the relying party.
+func (rp RelyingParty) RequestOptions(challenge string, allow [][]byte, timeout time.Duration) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          timeout.Milliseconds(),
+		RPID:             rp.ID,
+		AllowCredentials: descriptors(allow),
+		UserVerification: "required",
+	}
+}
+
+func descriptors(ids [][]byte) []CredentialDescriptor {
+	list := []CredentialDescriptor{}
+	for _, id := range ids {
+		list = append(list, CredentialDescriptor{Type: "public-key", ID: Encoding.EncodeToString(id)})
+	}
+	return list
+}
+
+// ClientData is the client data the browser collected during a ceremony. Callers look the
+// challenge up to find the ceremony it belongs to, the rest is checked by VerifyRegistration()
+// and VerifyAssertion().
+type ClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+
+	raw []byte
+}
+
+// ParseClientData() parses the clientDataJSON of a ceremony response
+func ParseClientData(raw []byte) (*ClientData, error) {
+	var clientData ClientData
+
+	err := json.Unmarshal(raw, &clientData)
+	if err != nil || clientData.Challenge == "" {
+		return nil, ErrInvalidCredential
+	}
+
+	clientData.raw = raw
+
+	return &clientData, nil
+}
+
+func (rp RelyingParty) checkClientData(clientData *ClientData, ceremony string) error {
+	if clientData.Type != ceremony || clientData.CrossOrigin || !slices.Contains(rp.Origins, clientData.Origin) {
+		return ErrInvalidCredential
+	}
+
+	return nil
+}
+
+// authenticatorData is the parsed authenticator data (WebAuthn section 6.1)
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, ErrInvalidCredential
+	}
+
+	data := &authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+
+	rest := b[37:]
+
+	if data.flags&flagAttestedData != 0 {
+		// AAGUID, credential id length, credential id, then the public key
+		if len(rest) < 18 {
+			return nil, ErrInvalidCredential
+		}
+
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+
+		if idLength == 0 || idLength > 1023 || len(rest) < idLength {
+			return nil, ErrInvalidCredential
+		}
+
+		data.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, n, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, ErrInvalidCredential
+		}
+
+		data.publicKey = rest[:n]
+		rest = rest[n:]
+	}
+
+	// We don't use any extensions, but they have to be well-formed
+	if data.flags&flagExtensions != 0 {
+		_, n, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, ErrInvalidCredential
+		}
+		rest = rest[n:]
+	}
+
+	if len(rest) != 0 {
+		return nil, ErrInvalidCredential
+	}
+
+	return data, nil
+}
+
+// checkAuthenticatorData() checks the passkey is for our relying party, and that the user was
+// both present and verified by the authenticator
+func (rp RelyingParty) checkAuthenticatorData(data *authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+
+	if !bytes.Equal(data.rpIDHash, rpIDHash[:]) {
+		return ErrInvalidCredential
+	}
+
+	if data.flags&flagUserPresent == 0 || data.flags&flagUserVerified == 0 {
+		return ErrInvalidCredential
+	}
+
+	return nil
+}
+
+// VerifyRegistration() verifies the response to navigator.credentials.create() and returns the
+// new passkey. The caller must have matched the client data challenge to the registration it
+// started. The attestation statement isn't verified, we ask for none and only ever trust the key.
+func (rp RelyingParty) VerifyRegistration(clientData *ClientData, attestationObject []byte) (*Credential, error) {
+	err := rp.checkClientData(clientData, "webauthn.create")
+	if err != nil {
+		return nil, err
+	}
+
+	value, n, err := decodeCBOR(attestationObject)
+	if err != nil || n != len(attestationObject) {
+		return nil, ErrInvalidCredential
+	}
+
+	attestation, ok := value.(map[any]any)
+	if !ok {
+		return nil, ErrInvalidCredential
+	}
+
+	authData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, ErrInvalidCredential
+	}
+
+	data, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rp.checkAuthenticatorData(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.flags&flagAttestedData == 0 {
+		return nil, ErrInvalidCredential
+	}
+
+	_, err = parsePublicKey(data.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	credential := &Credential{
+		ID:        bytes.Clone(data.credentialID),
+		PublicKey: bytes.Clone(data.publicKey),
+		SignCount: data.signCount,
+	}
+
+	return credential, nil
+}
+
+// VerifyAssertion() verifies the response to navigator.credentials.get() against the stored
+// public key and signature counter of the passkey, and returns the new counter value. The caller
+// must have matched the client data challenge to the login it started.
+func (rp RelyingParty) VerifyAssertion(clientData *ClientData, authenticatorData, signature, publicKey []byte, signCount uint32) (uint32, error) {
+	err := rp.checkClientData(clientData, "webauthn.get")
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := parseAuthenticatorData(authenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	err = rp.checkAuthenticatorData(data)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	// the signature covers the authenticator data and the hash of the client data
+	clientDataHash := sha256.Sum256(clientData.raw)
+	message := append(bytes.Clone(authenticatorData), clientDataHash[:]...)
+
+	if !key.verify(message, signature) {
+		return 0, ErrInvalidCredential
+	}
+
+	// Authenticators which don't count signatures always send 0
+	if (data.signCount != 0 || signCount != 0) && data.signCount <= signCount {
+		return 0, ErrClonedAuthenticator
+	}
+
+	return data.signCount, nil
+}
@@ -0,0 +1,436 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const (
+	testRPID      = "greenlight.example"
+	testOrigin    = "https://greenlight.example"
+	testChallenge = "challenge-value"
+)
+
+var testRP = RelyingParty{ID: testRPID, Name: "Greenlight", Origins: []string{testOrigin}}
+
+// authenticator is a software authenticator holding an ES256 or Ed25519 key. It builds the
+// authenticator data and attestation objects by hand, the way a real one lays them out.
+type authenticator struct {
+	t  *testing.T
+	id []byte
+
+	alg     int64
+	ecKey   *ecdsa.PrivateKey
+	edKey   ed25519.PrivateKey
+	edPub   ed25519.PublicKey
+	counter uint32
+}
+
+func newAuthenticator(t *testing.T, alg int64) *authenticator {
+	t.Helper()
+
+	a := &authenticator{t: t, id: make([]byte, 16), alg: alg}
+
+	_, err := rand.Read(a.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch alg {
+	case AlgES256:
+		a.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgEdDSA:
+		a.edPub, a.edKey, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		t.Fatalf("unsupported algorithm %d", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+// publicKey() returns the authenticator's public key as a COSE_Key
+func (a *authenticator) publicKey() []byte {
+	if a.alg == AlgEdDSA {
+		return encodeCBOR([]cborPair{
+			{coseKty, coseKtyOKP},
+			{coseAlg, AlgEdDSA},
+			{coseCrv, coseCrvEd25519},
+			{coseX, []byte(a.edPub)},
+		})
+	}
+
+	return encodeCBOR([]cborPair{
+		{coseKty, coseKtyEC2},
+		{coseAlg, AlgES256},
+		{coseCrv, coseCrvP256},
+		{coseX, a.ecKey.X.FillBytes(make([]byte, 32))},
+		{coseY, a.ecKey.Y.FillBytes(make([]byte, 32))},
+	})
+}
+
+// authData() returns authenticator data for rpID with the given flags and counter. With
+// flagAttestedData set it includes the credential id and public key, as in a registration.
+func (a *authenticator) authData(rpID string, flags byte, counter uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	b := append(rpIDHash[:], flags)
+	b = binary.BigEndian.AppendUint32(b, counter)
+
+	if flags&flagAttestedData != 0 {
+		b = append(b, make([]byte, 16)...) // AAGUID, all zeros with no attestation
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, a.publicKey()...)
+	}
+
+	return b
+}
+
+// attestationObject() wraps authData in a "none" attestation object
+func (a *authenticator) attestationObject(authData []byte) []byte {
+	return encodeCBOR([]cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", authData},
+	})
+}
+
+// sign() signs the authenticator data and the hash of the client data, as in an assertion
+func (a *authenticator) sign(authData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	message := append(bytes.Clone(authData), clientDataHash[:]...)
+
+	if a.alg == AlgEdDSA {
+		return ed25519.Sign(a.edKey, message)
+	}
+
+	digest := sha256.Sum256(message)
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.ecKey, digest[:])
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return signature
+}
+
+// assert() returns the authenticator data and signature for a login, bumping the counter
+func (a *authenticator) assert(clientDataJSON []byte) ([]byte, []byte) {
+	a.counter++
+
+	authData := a.authData(testRPID, flagUserPresent|flagUserVerified, a.counter)
+
+	return authData, a.sign(authData, clientDataJSON)
+}
+
+// clientDataJSON() returns the client data a browser would collect for a ceremony
+func clientDataJSON(t *testing.T, ceremony, origin string) []byte {
+	t.Helper()
+
+	raw, err := json.Marshal(map[string]any{
+		"type":        ceremony,
+		"challenge":   testChallenge,
+		"origin":      origin,
+		"crossOrigin": false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return raw
+}
+
+func parseClientData(t *testing.T, raw []byte) *ClientData {
+	t.Helper()
+
+	clientData, err := ParseClientData(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clientData
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	for _, alg := range []int64{AlgES256, AlgEdDSA} {
+		a := newAuthenticator(t, alg)
+
+		authData := a.authData(testRPID, flagUserPresent|flagUserVerified|flagAttestedData, 0)
+		clientData := parseClientData(t, clientDataJSON(t, "webauthn.create", testOrigin))
+
+		credential, err := testRP.VerifyRegistration(clientData, a.attestationObject(authData))
+		if err != nil {
+			t.Fatalf("alg %d: registration failed: %v", alg, err)
+		}
+
+		if !bytes.Equal(credential.ID, a.id) || !bytes.Equal(credential.PublicKey, a.publicKey()) || credential.SignCount != 0 {
+			t.Fatalf("alg %d: unexpected credential %+v", alg, credential)
+		}
+
+		signCount := credential.SignCount
+
+		// the counter has to keep going up from one login to the next
+		for i := 0; i < 2; i++ {
+			raw := clientDataJSON(t, "webauthn.get", testOrigin)
+			authData, signature := a.assert(raw)
+
+			signCount, err = testRP.VerifyAssertion(parseClientData(t, raw), authData, signature, credential.PublicKey, signCount)
+			if err != nil {
+				t.Fatalf("alg %d: assertion %d failed: %v", alg, i+1, err)
+			}
+
+			if signCount != a.counter {
+				t.Errorf("alg %d: got sign count %d, want %d", alg, signCount, a.counter)
+			}
+		}
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	a := newAuthenticator(t, AlgES256)
+
+	valid := a.authData(testRPID, flagUserPresent|flagUserVerified|flagAttestedData, 0)
+
+	tests := []struct {
+		name              string
+		clientData        []byte
+		attestationObject []byte
+		err               error
+	}{
+		{
+			name:              "wrong origin",
+			clientData:        clientDataJSON(t, "webauthn.create", "https://evil.example"),
+			attestationObject: a.attestationObject(valid),
+		},
+		{
+			name:              "wrong ceremony",
+			clientData:        clientDataJSON(t, "webauthn.get", testOrigin),
+			attestationObject: a.attestationObject(valid),
+		},
+		{
+			name:              "wrong rpIdHash",
+			clientData:        clientDataJSON(t, "webauthn.create", testOrigin),
+			attestationObject: a.attestationObject(a.authData("evil.example", flagUserPresent|flagUserVerified|flagAttestedData, 0)),
+		},
+		{
+			name:              "missing UV",
+			clientData:        clientDataJSON(t, "webauthn.create", testOrigin),
+			attestationObject: a.attestationObject(a.authData(testRPID, flagUserPresent|flagAttestedData, 0)),
+		},
+		{
+			name:              "missing UP",
+			clientData:        clientDataJSON(t, "webauthn.create", testOrigin),
+			attestationObject: a.attestationObject(a.authData(testRPID, flagUserVerified|flagAttestedData, 0)),
+		},
+		{
+			name:              "no attested credential",
+			clientData:        clientDataJSON(t, "webauthn.create", testOrigin),
+			attestationObject: a.attestationObject(a.authData(testRPID, flagUserPresent|flagUserVerified, 0)),
+		},
+		{
+			name:              "trailing authenticator data",
+			clientData:        clientDataJSON(t, "webauthn.create", testOrigin),
+			attestationObject: a.attestationObject(append(bytes.Clone(valid), 0x00)),
+		},
+		{
+			name:              "trailing attestation object",
+			clientData:        clientDataJSON(t, "webauthn.create", testOrigin),
+			attestationObject: append(a.attestationObject(valid), 0x00),
+		},
+		{
+			name:              "missing authData",
+			clientData:        clientDataJSON(t, "webauthn.create", testOrigin),
+			attestationObject: encodeCBOR([]cborPair{{"fmt", "none"}, {"attStmt", []cborPair{}}}),
+		},
+		{
+			name:              "unsupported algorithm",
+			clientData:        clientDataJSON(t, "webauthn.create", testOrigin),
+			attestationObject: a.attestationObject(bytes.Replace(valid, append(encodeCBOR(coseAlg), encodeCBOR(AlgES256)...), append(encodeCBOR(coseAlg), encodeCBOR(-36)...), 1)),
+			err:               ErrUnsupportedAlgorithm,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.err
+			if want == nil {
+				want = ErrInvalidCredential
+			}
+
+			_, err := testRP.VerifyRegistration(parseClientData(t, tt.clientData), tt.attestationObject)
+			if !errors.Is(err, want) {
+				t.Fatalf("got error %v, want %v", err, want)
+			}
+		})
+	}
+}
+
+func TestVerifyAssertionRejects(t *testing.T) {
+	for _, alg := range []int64{AlgES256, AlgEdDSA} {
+		a := newAuthenticator(t, alg)
+		raw := clientDataJSON(t, "webauthn.get", testOrigin)
+		flags := byte(flagUserPresent | flagUserVerified)
+
+		tests := []struct {
+			name       string
+			clientData []byte
+			authData   []byte
+			signature  func(authData []byte) []byte
+			signCount  uint32
+			err        error
+		}{
+			{
+				name:       "wrong origin",
+				clientData: clientDataJSON(t, "webauthn.get", "https://evil.example"),
+				authData:   a.authData(testRPID, flags, 1),
+			},
+			{
+				name:       "wrong ceremony",
+				clientData: clientDataJSON(t, "webauthn.create", testOrigin),
+				authData:   a.authData(testRPID, flags, 1),
+			},
+			{
+				name:       "wrong rpIdHash",
+				clientData: raw,
+				authData:   a.authData("evil.example", flags, 1),
+			},
+			{
+				name:       "missing UV",
+				clientData: raw,
+				authData:   a.authData(testRPID, flagUserPresent, 1),
+			},
+			{
+				name:       "bad signature",
+				clientData: raw,
+				authData:   a.authData(testRPID, flags, 1),
+				signature: func(authData []byte) []byte {
+					signature := a.sign(authData, raw)
+					signature[len(signature)-1] ^= 0x01
+					return signature
+				},
+			},
+			{
+				name:       "signature over other client data",
+				clientData: raw,
+				authData:   a.authData(testRPID, flags, 1),
+				signature: func(authData []byte) []byte {
+					return a.sign(authData, clientDataJSON(t, "webauthn.get", "https://evil.example"))
+				},
+			},
+			{
+				name:       "signature by another key",
+				clientData: raw,
+				authData:   a.authData(testRPID, flags, 1),
+				signature: func(authData []byte) []byte {
+					return newAuthenticator(t, alg).sign(authData, raw)
+				},
+			},
+			{
+				name:       "counter regression",
+				clientData: raw,
+				authData:   a.authData(testRPID, flags, 4),
+				signCount:  5,
+				err:        ErrClonedAuthenticator,
+			},
+			{
+				name:       "counter repeated",
+				clientData: raw,
+				authData:   a.authData(testRPID, flags, 5),
+				signCount:  5,
+				err:        ErrClonedAuthenticator,
+			},
+			{
+				name:       "counter reset to zero",
+				clientData: raw,
+				authData:   a.authData(testRPID, flags, 0),
+				signCount:  5,
+				err:        ErrClonedAuthenticator,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				signature := a.sign(tt.authData, tt.clientData)
+				if tt.signature != nil {
+					signature = tt.signature(tt.authData)
+				}
+
+				want := tt.err
+				if want == nil {
+					want = ErrInvalidCredential
+				}
+
+				_, err := testRP.VerifyAssertion(parseClientData(t, tt.clientData), tt.authData, signature, a.publicKey(), tt.signCount)
+				if !errors.Is(err, want) {
+					t.Fatalf("alg %d: got error %v, want %v", alg, err, want)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyAssertionWithoutCounter(t *testing.T) {
+	// authenticators which don't count signatures always send 0, which isn't a regression
+	a := newAuthenticator(t, AlgEdDSA)
+	raw := clientDataJSON(t, "webauthn.get", testOrigin)
+	authData := a.authData(testRPID, flagUserPresent|flagUserVerified, 0)
+
+	signCount, err := testRP.VerifyAssertion(parseClientData(t, raw), authData, a.sign(authData, raw), a.publicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signCount != 0 {
+		t.Errorf("got sign count %d, want 0", signCount)
+	}
+}
+
+func TestParsePublicKeyRejectsPointOffCurve(t *testing.T) {
+	key := encodeCBOR([]cborPair{
+		{coseKty, coseKtyEC2},
+		{coseAlg, AlgES256},
+		{coseCrv, coseCrvP256},
+		{coseX, bytes.Repeat([]byte{0x01}, 32)},
+		{coseY, bytes.Repeat([]byte{0x02}, 32)},
+	})
+
+	_, err := parsePublicKey(key)
+	if !errors.Is(err, ErrInvalidCredential) {
+		t.Fatalf("got error %v, want %v", err, ErrInvalidCredential)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		valid   bool
+	}{
+		{name: "same domain", origins: []string{testOrigin}, valid: true},
+		{name: "subdomain", origins: []string{"https://app.greenlight.example:8443"}, valid: true},
+		{name: "other domain", origins: []string{"https://greenlight.example.evil"}},
+		{name: "suffix without dot", origins: []string{"https://notgreenlight.example"}},
+		{name: "path", origins: []string{testOrigin + "/login"}},
+		{name: "no origins"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RelyingParty{ID: testRPID, Origins: tt.origins}.Validate()
+			if (err == nil) != tt.valid {
+				t.Fatalf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key text NOT NULL,
+    user_id bigint NOT NULL,
+    request_hash bytea NOT NULL,
+    response_status integer,
+    response_headers jsonb,
+    response_body bytea,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL,
+    PRIMARY KEY (key, user_id)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS token_denylist (
+    id bigserial PRIMARY KEY,
+    jti text NOT NULL DEFAULT '',
+    user_id bigint NOT NULL DEFAULT 0,
+    revoked_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS token_denylist_expiry_idx ON token_denylist (expiry);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS login_failures (
+    key text PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure timestamp with time zone NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO permissions (code)
+VALUES
+    ('users:admin');
@@ -0,0 +1,16 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS users_deletion_scheduled_at_idx ON users (deletion_scheduled_at)
+WHERE deletion_scheduled_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS data_exports (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    status text NOT NULL DEFAULT 'pending',
+    archive jsonb,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    completed_at timestamp(0) with time zone,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS data_exports_user_id_idx ON data_exports (user_id);
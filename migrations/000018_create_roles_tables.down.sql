@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
+
+DELETE FROM permissions WHERE code IN ('movies:*', 'users:*', '*:read', '*:*');
@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- Wildcard codes grant every permission they match, like movies:read and movies:write for movies:*
+INSERT INTO permissions (code)
+VALUES
+    ('movies:*'),
+    ('users:*'),
+    ('*:read'),
+    ('*:*');
+
+INSERT INTO roles (name, description)
+VALUES
+    ('viewer', 'Can browse movies'),
+    ('editor', 'Can browse, add, edit and delete movies');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE (roles.name = 'viewer' AND permissions.code = 'movies:read')
+OR (roles.name = 'editor' AND permissions.code = 'movies:*');
@@ -0,0 +1,13 @@
+DELETE FROM roles_permissions
+WHERE role_id = (SELECT id FROM roles WHERE name = 'editor')
+AND permission_id IN (SELECT id FROM permissions WHERE code IN ('movies:read', 'movies:write'));
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'editor' AND permissions.code = 'movies:*'
+ON CONFLICT DO NOTHING;
+
+DELETE FROM permissions WHERE code IN ('movies:moderate', 'movies:admin');
+
+DROP INDEX IF EXISTS movies_created_by_idx;
+ALTER TABLE movies DROP COLUMN IF EXISTS created_by;
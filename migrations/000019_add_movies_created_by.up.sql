@@ -0,0 +1,19 @@
+-- Movies stay when their creator's account is deleted, they just no longer have an owner
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+
+INSERT INTO permissions (code)
+VALUES
+    ('movies:moderate'),
+    ('movies:admin');
+
+-- movies:* now also covers moderating and deleting, which editors shouldn't get
+DELETE FROM roles_permissions
+WHERE role_id = (SELECT id FROM roles WHERE name = 'editor')
+AND permission_id IN (SELECT id FROM permissions WHERE code = 'movies:*');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id FROM roles, permissions
+WHERE roles.name = 'editor' AND permissions.code IN ('movies:read', 'movies:write')
+ON CONFLICT DO NOTHING;
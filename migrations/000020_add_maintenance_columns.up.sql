@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS activation_reminder_sent_at timestamp(0) with time zone;
+
+CREATE INDEX IF NOT EXISTS users_unactivated_created_at_idx ON users (created_at) WHERE activated = false;
+
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS invitations (
+    id bigserial PRIMARY KEY,
+    email citext NOT NULL,
+    hash bytea UNIQUE NOT NULL,
+    permissions text[] NOT NULL DEFAULT '{}',
+    invited_by bigint REFERENCES users ON DELETE SET NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry timestamp(0) with time zone NOT NULL,
+    accepted_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS invitations_email_idx ON invitations (email);
+CREATE INDEX IF NOT EXISTS invitations_expiry_idx ON invitations (expiry);
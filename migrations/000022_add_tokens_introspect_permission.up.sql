@@ -0,0 +1,3 @@
+-- Lets internal services validate tokens presented to them, usually granted to their API key
+INSERT INTO permissions (code)
+VALUES ('tokens:introspect');
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS passkeys (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    name text NOT NULL,
+    credential_id bytea UNIQUE NOT NULL,
+    public_key bytea NOT NULL,
+    sign_count bigint NOT NULL DEFAULT 0,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_used_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS passkeys_user_id_idx ON passkeys (user_id);
+
+-- Challenges of registrations and logins in progress. Logins don't know the user yet, so their
+-- challenges have no user_id.
+CREATE TABLE IF NOT EXISTS passkey_challenges (
+    hash bytea PRIMARY KEY,
+    user_id bigint REFERENCES users ON DELETE CASCADE,
+    expiry timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS passkey_challenges_expiry_idx ON passkey_challenges (expiry);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idempotency_keys_expiry_idx;
+
+DELETE FROM idempotency_keys WHERE client <> '';
+
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key, user_id);
+
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS client;
@@ -0,0 +1,7 @@
+-- Anonymous requests all have user_id 0, so their keys are also scoped by the client's IP address
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS client text NOT NULL DEFAULT '';
+
+ALTER TABLE idempotency_keys DROP CONSTRAINT IF EXISTS idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key, user_id, client);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expiry_idx ON idempotency_keys (expiry);
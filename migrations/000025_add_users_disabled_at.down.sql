@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS users_unactivated_created_at_idx;
+CREATE INDEX IF NOT EXISTS users_unactivated_created_at_idx ON users (created_at) WHERE activated = false;
+
+ALTER TABLE users DROP COLUMN IF EXISTS disabled_at;
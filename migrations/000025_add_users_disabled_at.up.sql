@@ -0,0 +1,6 @@
+-- Accounts disabled by an admin, kept apart from activated so a disabled account can't be
+-- mistaken for one which was never activated
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at timestamp(0) with time zone;
+
+DROP INDEX IF EXISTS users_unactivated_created_at_idx;
+CREATE INDEX IF NOT EXISTS users_unactivated_created_at_idx ON users (created_at) WHERE activated = false AND disabled_at IS NULL;
@@ -0,0 +1,5 @@
+-- An unfinished request only holds its key until locked_until, after that a retry can take it over
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS locked_until timestamp(0) with time zone;
+
+-- keys still held by requests from before the upgrade can be taken over straight away
+UPDATE idempotency_keys SET locked_until = created_at WHERE response_status IS NULL;
@@ -0,0 +1,3 @@
+DELETE FROM token_denylist WHERE family <> '';
+
+ALTER TABLE token_denylist DROP COLUMN IF EXISTS family;
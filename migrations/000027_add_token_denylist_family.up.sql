@@ -0,0 +1,2 @@
+-- A family entry revokes the signed tokens of one session, which all carry its family in the fam claim
+ALTER TABLE token_denylist ADD COLUMN IF NOT EXISTS family text NOT NULL DEFAULT '';
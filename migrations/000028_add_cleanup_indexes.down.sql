@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS login_failures_last_failure_idx;
+DROP INDEX IF EXISTS oidc_login_states_expiry_idx;
@@ -0,0 +1,3 @@
+-- for the maintenance jobs which delete expired login states and old login failures
+CREATE INDEX IF NOT EXISTS oidc_login_states_expiry_idx ON oidc_login_states (expiry);
+CREATE INDEX IF NOT EXISTS login_failures_last_failure_idx ON login_failures (last_failure);